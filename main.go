@@ -1,31 +1,70 @@
 package main
 
 import (
+	"context"
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 // エンティティ定義
 type Product struct {
-	ID       int    `json:"id"`
-	Name     string `json:"name"`
-	Price    int    `json:"price"`
-	Category string `json:"category"`
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Price        int    `json:"price"`
+	Category     string `json:"category"`
+	Featured     bool   `json:"featured"`                // おすすめ商品として掲載するか（管理者が設定）
+	FeaturedRank int    `json:"featured_rank,omitempty"` // おすすめ商品の表示順（小さいほど上位）
+
+	AvailableFrom time.Time `json:"available_from"` // 販売開始日時（ゼロ値は即時販売、未来日時の間は予約商品）
+	SafetyStock   int       `json:"safety_stock"`   // オンライン販売しない安全在庫数（0の場合は SAFETY_STOCK を使う）
+
+	PriceTiers []PriceTier `json:"price_tiers,omitempty"` // 数量に応じた段階価格（未設定は Price のみ）
+	ExternalID string      `json:"external_id,omitempty"` // 外部システムの商品ID（カタログ同期の重複作成防止）
+}
+
+// 数量段階価格（MinQty 個以上の注文で UnitPrice を適用）
+type PriceTier struct {
+	MinQty    int `json:"min_qty"`
+	UnitPrice int `json:"unit_price"`
 }
 
 // 倉庫エンティティ
 type Warehouse struct {
 	ID   int    `json:"id"`
 	Name string `json:"name"`
+
+	Capacity int `json:"capacity"` // 保管できる在庫数の上限（0は無制限）
+
+	Latitude  float64 `json:"latitude,omitempty"`  // 緯度（緯度・経度とも0は位置未設定）
+	Longitude float64 `json:"longitude,omitempty"` // 経度
+
+	AllocationFloor int `json:"allocation_floor,omitempty"` // 店頭用に残す在庫数（0の場合は ALLOCATION_FLOOR を使う）
+}
+
+// 緯度・経度で表す地点
+type GeoPoint struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
 }
 
 // 在庫エンティティ（商品と倉庫の関連）
@@ -43,6 +82,12 @@ type ProductDetailResponse struct {
 	Category    string           `json:"category"`
 	TotalStock  int              `json:"total_stock"`
 	StockDetail []StockWarehouse `json:"stock_detail"`
+
+	PreOrder      bool       `json:"pre_order"`                // 販売開始前（注文不可）
+	AvailableFrom *time.Time `json:"available_from,omitempty"` // 販売開始日時（設定がある場合のみ）
+
+	PriceTiers []PriceTier `json:"price_tiers,omitempty"` // 数量段階価格
+	ExternalID string      `json:"external_id,omitempty"`
 }
 
 type StockWarehouse struct {
@@ -59,11 +104,47 @@ type User struct {
 	CurrentPoints    int    `json:"current_points"`
 	TotalSpentAmount int    `json:"total_spent_amount"`
 	MemberRank       string `json:"rank"` // "Normal", "Silver", "Gold"
+
+	CreatedAt time.Time `json:"created_at"` // 会員登録日時
 }
 
 type OrderItem struct {
-	ProductID int `json:"product_id"`
-	Quantity  int `json:"quantity"`
+	ProductID   int    `json:"product_id"`
+	Quantity    int    `json:"quantity"`
+	UnitPrice   int    `json:"unit_price"`             // 注文時点の単価（注文作成時にサーバー側で設定）
+	ProductName string `json:"product_name,omitempty"` // 注文時点の商品名（注文作成時にサーバー側で設定）
+
+	SaleDiscount int `json:"sale_discount,omitempty"` // カテゴリセールによる明細の割引額（注文作成時にサーバー側で設定）
+
+	IsGift bool `json:"is_gift,omitempty"` // 購入金額特典のプレゼント（単価0、サーバー側で追加）
+}
+
+// 注文作成リクエスト（POST /orders と POST /cart/checkout で共通）
+type CreateOrderRequest struct {
+	Items      []OrderItem `json:"items"`
+	CouponCode string      `json:"coupon_code,omitempty"`
+	UsePoints  int         `json:"use_points,omitempty"`
+
+	AllowDuplicate bool `json:"allow_duplicate,omitempty"` // 意図的な同一内容の再注文
+	AutoCoupon     bool `json:"auto_coupon,omitempty"`     // coupon_code 未指定時に最適なクーポンを自動適用
+
+	// 配送先（緯度・経度または郵便番号、省略時は従来の引当方針）
+	Destination struct {
+		Latitude   float64 `json:"latitude,omitempty"`
+		Longitude  float64 `json:"longitude,omitempty"`
+		PostalCode string  `json:"postal_code,omitempty"`
+	} `json:"destination,omitempty"`
+
+	// ギフト注文（is_gift の場合は受取人の氏名・住所が必須）
+	IsGift        bool           `json:"is_gift,omitempty"`
+	GiftRecipient *GiftRecipient `json:"gift_recipient,omitempty"`
+	GiftMessage   string         `json:"gift_message,omitempty"`
+}
+
+// ギフトの受取人
+type GiftRecipient struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
 }
 
 type Order struct {
@@ -78,15 +159,260 @@ type Order struct {
 	CreatedAt      time.Time   `json:"created_at"`
 	EarnedPoints   int         `json:"earned_points"`
 	UsedPoints     int         `json:"used_points"`
-	RankDiscount   int         `json:"rank_discount"` // ランク割引額
+	PointsDiscount int         `json:"points_discount"` // 利用ポイントによる値引き額（used_points × POINTS_REDEMPTION_RATE）
+	RankDiscount   int         `json:"rank_discount"`   // ランク割引額
+	Tax            int         `json:"tax"`             // 消費税額
+	TransactionID  string      `json:"transaction_id,omitempty"`
+
+	AppliedBenefits *AppliedBenefits `json:"applied_benefits,omitempty"` // 注文時点で適用されたルールの記録
+
+	CancelledAt  *time.Time          `json:"cancelled_at,omitempty"`
+	CancelReason string              `json:"cancel_reason,omitempty"` // キャンセル理由コード
+	Allocations  map[int]map[int]int `json:"-"`                       // 引当済み在庫（productID -> warehouseID -> quantity）、キャンセル時の在庫戻しに使う
+
+	Destination *GeoPoint `json:"destination,omitempty"` // 配送先（近い倉庫からの引当に使う）
+
+	Carrier        string     `json:"carrier,omitempty"`         // 配送業者
+	TrackingNumber string     `json:"tracking_number,omitempty"` // 追跡番号
+	ShippedAt      *time.Time `json:"shipped_at,omitempty"`
+
+	StatusHistory []OrderStatusChange `json:"-"` // ステータスの変更履歴（古い順）
+
+	OrderFlags []string `json:"-"` // 注文時に検出した不正の疑いのシグナル（管理者向けの表示のみ）
+
+	Refunds []OrderRefund `json:"refunds,omitempty"` // 一部返金の記録（古い順）
+
+	IsGift        bool           `json:"is_gift,omitempty"` // ギフト注文（領収書に金額を表示しない）
+	GiftRecipient *GiftRecipient `json:"gift_recipient,omitempty"`
+	GiftMessage   string         `json:"gift_message,omitempty"`
+}
+
+// 一部返金の記録
+type OrderRefund struct {
+	ID             int          `json:"id"` // 注文内の連番
+	Items          []RefundLine `json:"items"`
+	Amount         int          `json:"amount"`          // 返金額（支払額を明細金額で按分）
+	ReturnedPoints int          `json:"returned_points"` // 返還した使用ポイント
+	RevokedPoints  int          `json:"revoked_points"`  // 取り消した付与ポイント
+	RefundedAt     time.Time    `json:"refunded_at"`
+	RefundedBy     int          `json:"refunded_by"` // 返金を行ったユーザーのID
+}
+
+// 返金する明細
+type RefundLine struct {
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+// 不正の疑いのシグナル（注文はブロックせず記録のみ）
+const (
+	orderFlagHighQuantity          = "high_quantity"
+	orderFlagLargePointsRedemption = "large_points_redemption"
+	orderFlagNewAccountLargeOrder  = "new_account_large_order"
+	orderFlagDiscountCapped        = "discount_capped" // 割引合計が上限を超えたため減額した
+	orderFlagRefundRequired        = "refund_required" // キャンセル後に決済が成功した（決済ゲートウェイ側で返金が必要）
+)
+
+// 管理者向けの注文レスポンス（顧客には見せないシグナルを含める）
+type AdminOrderResponse struct {
+	*Order
+	OrderFlags []string `json:"order_flags"`
+}
+
+// 注文ステータスの変更記録
+type OrderStatusChange struct {
+	Status    string    `json:"status"`
+	ChangedAt time.Time `json:"changed_at"`
+	ChangedBy int       `json:"changed_by"` // 変更したユーザーのID
+}
+
+// 注文ステータス履歴のレスポンス
+type OrderStatusHistoryResponse struct {
+	OrderID int                 `json:"order_id"`
+	Status  string              `json:"status"` // 現在のステータス
+	History []OrderStatusChange `json:"history"`
+}
+
+// 注文時点で適用された価格ルールの記録（後から設定が変わっても注文内容を説明できるように保存する）
+type AppliedBenefits struct {
+	Rank                   string  `json:"rank"`                     // 注文時点の会員ランク
+	RankDiscountRate       float64 `json:"rank_discount_rate"`       // 適用したランク割引率
+	Coupon                 *Coupon `json:"coupon,omitempty"`         // 適用したクーポン条件のコピー
+	TaxRatePercent         int     `json:"tax_rate_percent"`         // 消費税率（%）
+	PointsRatePercent      int     `json:"points_rate_percent"`      // ポイント付与率（%）
+	PointsExclusionPercent int     `json:"points_exclusion_percent"` // ポイント付与除外の割引率しきい値（0は無効）
+	PointsRounding         string  `json:"points_rounding"`          // ポイント付与の端数処理
+	FreeShippingByRank     bool    `json:"free_shipping_by_rank"`    // ランク特典で送料無料か
+	FreeShippingThreshold  int     `json:"free_shipping_threshold"`  // 送料無料となる税込小計
+	StandardShippingFee    int     `json:"standard_shipping_fee"`    // 通常送料
+
+	CouponAutoApplied bool `json:"coupon_auto_applied,omitempty"` // auto_coupon により自動選択されたクーポンか
+
+	CategorySales map[string]int `json:"category_sales,omitempty"` // 適用したカテゴリセールの割引率（カテゴリ -> %）
+
+	MaxDiscountPercent int  `json:"max_discount_percent,omitempty"` // 割引合計の上限（セール前の商品小計に対する%、0は無効）
+	DiscountCapped     bool `json:"discount_capped,omitempty"`      // 上限を超えたためランク割引・クーポン割引を減額したか
+
+	PointsRedemptionRate float64 `json:"points_redemption_rate"` // 1ポイントあたりの値引き額
+}
+
+// 注文金額の計算結果
+type OrderTotals struct {
+	Subtotal       int `json:"subtotal"` // 商品小計（割引前）
+	RankDiscount   int `json:"rank_discount"`
+	Tax            int `json:"tax"`
+	ShippingFee    int `json:"shipping_fee"`
+	CouponDiscount int `json:"coupon_discount"`
+	UsedPoints     int `json:"used_points"`     // 実際に利用したポイント（支払額が上限）
+	PointsDiscount int `json:"points_discount"` // 利用ポイントによる値引き額
+	TotalPrice     int `json:"total_price"`
+	EarnedPoints   int `json:"earned_points"`
+
+	SaleDiscount   int  `json:"sale_discount,omitempty"`   // カテゴリセールの割引額（単価に反映済み、subtotal には含まない）
+	DiscountCapped bool `json:"discount_capped,omitempty"` // 割引の合計が MAX_DISCOUNT_PERCENT を超えたため減額したか
+}
+
+// 領収書レスポンス用の構造体
+type OrderReceipt struct {
+	OrderID        int               `json:"order_id"`
+	Status         string            `json:"status"`
+	TransactionID  string            `json:"transaction_id,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	LineItems      []ReceiptLineItem `json:"line_items"`
+	ItemsSubtotal  int               `json:"items_subtotal"`
+	RankDiscount   int               `json:"rank_discount"`
+	Tax            int               `json:"tax"`
+	ShippingFee    int               `json:"shipping_fee"`
+	CouponCode     string            `json:"coupon_code,omitempty"`
+	CouponDiscount int               `json:"coupon_discount"`
+	PointsUsed     int               `json:"points_used"`
+	PointsDiscount int               `json:"points_discount"` // 利用ポイントによる値引き額
+	PointsEarned   int               `json:"points_earned"`
+	TotalPrice     int               `json:"total_price"`
+
+	Formatted map[string]string `json:"formatted,omitempty"` // 表示用の金額文字列（?format=money 指定時のみ）
+}
+
+// ギフト注文の領収書（同梱用のため金額を含めない）
+type GiftReceipt struct {
+	OrderID       int               `json:"order_id"`
+	Status        string            `json:"status"`
+	CreatedAt     time.Time         `json:"created_at"`
+	IsGift        bool              `json:"is_gift"`
+	GiftRecipient *GiftRecipient    `json:"gift_recipient"`
+	GiftMessage   string            `json:"gift_message,omitempty"`
+	LineItems     []GiftReceiptLine `json:"line_items"`
+}
+
+type GiftReceiptLine struct {
+	ProductID   int    `json:"product_id"`
+	ProductName string `json:"product_name"`
+	Quantity    int    `json:"quantity"`
+}
+
+type ReceiptLineItem struct {
+	ProductID   int    `json:"product_id"`
+	ProductName string `json:"product_name"`
+	UnitPrice   int    `json:"unit_price"`
+	Quantity    int    `json:"quantity"`
+	Subtotal    int    `json:"subtotal"`
+
+	SaleDiscount int `json:"sale_discount,omitempty"` // カテゴリセールによる明細の割引額
+
+	FormattedUnitPrice string `json:"formatted_unit_price,omitempty"`
+	FormattedSubtotal  string `json:"formatted_subtotal,omitempty"`
 }
 
 // クーポンエンティティ
 type Coupon struct {
 	Code         string `json:"code"`
-	Type         string `json:"type"`         // "fixed" or "percentage"
-	Amount       int    `json:"amount"`       // 固定額または割合（%）
+	Type         string `json:"type"`         // "fixed", "percentage" or "shipping"
+	Amount       int    `json:"amount"`       // 固定額または割合（%）。shipping は送料に対する割合（100で送料無料）
 	Description  string `json:"description"`
+
+	// 利用条件（ゼロ値は条件なし）
+	MinOrderAmount int        `json:"min_order_amount,omitempty"` // 利用に必要な商品小計（割引前）
+	ValidFrom      *time.Time `json:"valid_from,omitempty"`       // 利用開始日時
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`       // 有効期限
+	Category       string     `json:"category,omitempty"`         // 対象カテゴリ（この商品を含む注文のみ利用可）
+
+	UsageLimit        int  `json:"usage_limit,omitempty"`         // 全ユーザー合計の利用回数上限（完了注文で数える）
+	FirstPurchaseOnly bool `json:"first_purchase_only,omitempty"` // 初回購入（完了注文がないユーザー）のみ利用可
+}
+
+// カテゴリセール（コード不要で対象カテゴリの商品を期間中割引する）
+type CategorySale struct {
+	ID         int       `json:"id"`
+	Category   string    `json:"category"`
+	PercentOff int       `json:"percent_off"` // 割引率（%）
+	ValidFrom  time.Time `json:"valid_from"`
+	ValidUntil time.Time `json:"valid_until"`
+}
+
+// 購入金額特典（商品小計がしきい値以上の注文にプレゼント商品を1個追加する）
+type GiftRule struct {
+	ID            int `json:"id"`
+	Threshold     int `json:"threshold"`       // 商品小計（税抜・カテゴリセール適用後、クーポン適用前）
+	GiftProductID int `json:"gift_product_id"` // プレゼントする商品
+}
+
+// 商品ページに表示する利用可能なクーポン
+type ProductCouponResponse struct {
+	Coupon
+	UnitDiscount int `json:"unit_discount"` // 商品1個に適用した場合の割引額（送料クーポンは0）
+}
+
+// クーポンの一括検証の結果（コードごと）
+type CouponValidationResult struct {
+	Code    string `json:"code"`
+	Exists  bool   `json:"exists"`           // クーポンが存在するか
+	Valid   bool   `json:"valid"`            // 現在、呼び出したユーザーが利用できるか
+	Reason  string `json:"reason,omitempty"` // 利用できない理由（クーポンのエラーと同じコード）
+	Message string `json:"message,omitempty"`
+}
+
+// 日別売上
+type DailyRevenue struct {
+	Date       string `json:"date"` // YYYY-MM-DD（サーバーのローカル時刻）
+	Revenue    int    `json:"revenue"`
+	OrderCount int    `json:"order_count"`
+}
+
+// 商品の日別販売数
+type DailyProductSales struct {
+	Date     string `json:"date"` // YYYY-MM-DD（サーバーのローカル時刻）
+	Quantity int    `json:"quantity"`
+}
+
+// 商品の日別販売数のレスポンス
+type ProductDailySalesResponse struct {
+	ProductID     int                 `json:"product_id"`
+	Name          string              `json:"name"`
+	TotalQuantity int                 `json:"total_quantity"` // 期間内の販売数の合計
+	Days          []DailyProductSales `json:"days"`
+}
+
+// 販売実績のない商品（滞留在庫の確認用）
+type NeverSoldProduct struct {
+	ProductID  int    `json:"product_id"`
+	Name       string `json:"name"`
+	Category   string `json:"category"`
+	Price      int    `json:"price"`
+	TotalStock int    `json:"total_stock"`
+}
+
+// クーポンごとの割引実績
+type CouponImpact struct {
+	Code          string `json:"code"`
+	TotalDiscount int    `json:"total_discount"` // 割引額（discount_amount）の合計
+	UsageCount    int    `json:"usage_count"`    // 利用された完了注文の数
+}
+
+// 会員ランクごとの人数
+type RankDistribution struct {
+	Rank      string `json:"rank"`
+	MinSpent  int    `json:"min_spent"` // ランクの累計購入金額の下限（区分にないランクは0）
+	UserCount int    `json:"user_count"`
 }
 
 // 販売分析レポート関連の型定義
@@ -94,6 +420,8 @@ type SalesReportResponse struct {
 	SalesSummary         SalesSummary             `json:"sales_summary"`
 	TopProducts          []ProductRanking         `json:"top_products"`
 	WarehouseInventory   []WarehouseInventoryStat `json:"warehouse_inventory"`
+	CategoryInventory    []CategoryInventoryStat  `json:"category_inventory"`
+	LowStockLocations    []LowStockLocation       `json:"low_stock_locations"`
 	PromotionAnalysis    PromotionAnalysis        `json:"promotion_analysis"`
 }
 
@@ -112,6 +440,20 @@ type WarehouseInventoryStat struct {
 	TotalStock    int    `json:"total_stock"`
 }
 
+// 在庫が少ない商品×倉庫の組み合わせ
+type LowStockLocation struct {
+	ProductID     int    `json:"product_id"`
+	ProductName   string `json:"product_name"`
+	WarehouseID   int    `json:"warehouse_id"`
+	WarehouseName string `json:"warehouse_name"`
+	Quantity      int    `json:"quantity"`
+}
+
+type CategoryInventoryStat struct {
+	Category   string `json:"category"`
+	TotalStock int    `json:"total_stock"`
+}
+
 type PromotionAnalysis struct {
 	CouponUsageRate float64 `json:"coupon_usage_rate"` // パーセンテージ（0-100）
 }
@@ -130,6 +472,269 @@ type ProductDetailResponseWithFavorite struct {
 	TotalStock  int              `json:"total_stock"`
 	StockDetail []StockWarehouse `json:"stock_detail"`
 	IsFavorite  bool             `json:"is_favorite"`
+
+	PreOrder      bool       `json:"pre_order"`                // 販売開始前（注文不可）
+	AvailableFrom *time.Time `json:"available_from,omitempty"` // 販売開始日時（設定がある場合のみ）
+
+	PriceTiers []PriceTier `json:"price_tiers,omitempty"` // 数量段階価格
+}
+
+// おすすめ商品一覧の要素
+type FeaturedProductResponse struct {
+	ProductDetailResponse
+	FeaturedRank int `json:"featured_rank"`
+}
+
+// お気に入りからの注文見積もり
+type WishlistCheckoutPreviewResponse struct {
+	Items    []WishlistPreviewItem `json:"items"`
+	Estimate OrderTotals           `json:"estimate"` // 在庫のある商品のみで算出（在庫のある商品がなければすべて0）
+}
+
+// お気に入り商品の合計金額
+type WishlistValueResponse struct {
+	TotalValue      int `json:"total_value"` // 現在価格の合計
+	ItemCount       int `json:"item_count"`
+	InStockCount    int `json:"in_stock_count"`
+	OutOfStockCount int `json:"out_of_stock_count"`
+	InStockValue    int `json:"in_stock_value"` // 在庫のある商品の現在価格の合計
+}
+
+type WishlistPreviewItem struct {
+	ProductID      int    `json:"product_id"`
+	Name           string `json:"name"`
+	Price          int    `json:"price"`
+	Quantity       int    `json:"quantity"`
+	AvailableStock int    `json:"available_stock"`
+	InStock        bool   `json:"in_stock"`
+}
+
+// カート内商品の検証結果
+type CartValidationItem struct {
+	ProductID      int    `json:"product_id"`
+	Name           string `json:"name,omitempty"`
+	Quantity       int    `json:"quantity"`
+	Exists         bool   `json:"exists"`          // 商品が存在するか
+	Available      bool   `json:"available"`       // 要求数量を注文できるか
+	AvailableStock int    `json:"available_stock"` // 注文可能な数量
+	CurrentPrice   int    `json:"current_price,omitempty"`
+	ExpectedPrice  int    `json:"expected_price,omitempty"` // クライアントが最後に見た価格
+	PriceChanged   bool   `json:"price_changed"`
+}
+
+type CartValidationResponse struct {
+	Valid bool                 `json:"valid"` // すべての商品がそのまま注文できるか
+	Items []CartValidationItem `json:"items"`
+}
+
+// サーバー側で保持するユーザーのカート
+type Cart struct {
+	UserID    int        `json:"user_id"`
+	Items     []CartItem `json:"items"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+type CartItem struct {
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+// カートの明細（現在の商品情報と価格を付けて返す）
+type CartLine struct {
+	ProductID int    `json:"product_id"`
+	Name      string `json:"name,omitempty"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice int    `json:"unit_price"` // 数量段階価格を適用した単価
+	LineTotal int    `json:"line_total"` // 単価×数量からカテゴリセールの割引を引いた金額
+	Available bool   `json:"available"`  // 商品が存在するか（削除済みは false）
+
+	SaleDiscount int `json:"sale_discount,omitempty"` // カテゴリセールによる明細の割引額
+}
+
+type CartResponse struct {
+	Items    []CartLine `json:"items"`
+	Subtotal int        `json:"subtotal"`          // 商品小計（税抜）
+	Skipped  []int      `json:"skipped,omitempty"` // 統合時にスキップした商品ID
+}
+
+// 在庫の事前確認結果（引当は行わない）
+type StockAvailability struct {
+	ProductID  int    `json:"product_id"`
+	Name       string `json:"name,omitempty"`
+	Requested  int    `json:"requested"`
+	Available  int    `json:"available"`  // 引当可能な数量（引当方針を考慮）
+	Found      bool   `json:"found"`      // 商品が存在するか
+	Sufficient bool   `json:"sufficient"` // 要求数量を満たす在庫があるか
+}
+
+// 有効なセッション情報（管理者向け、トークンはマスク済み）
+type SessionInfo struct {
+	UserID      int        `json:"user_id"`
+	Username    string     `json:"username"`
+	TokenPrefix string     `json:"token_prefix"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"` // 発行日時が記録されていない場合は省略
+}
+
+// クーポン利用注文一覧（キャンペーン効果測定用）
+type CouponOrdersResponse struct {
+	CouponCode      string   `json:"coupon_code"`
+	TotalOrders     int      `json:"total_orders"`
+	CompletedOrders int      `json:"completed_orders"`
+	FailedOrders    int      `json:"failed_orders"`
+	TotalRevenue    int      `json:"total_revenue"`  // 完了注文の支払総額
+	TotalDiscount   int      `json:"total_discount"` // 完了注文のクーポン割引総額
+	Orders          []*Order `json:"orders"`
+}
+
+// ポイント履歴一覧（ページング付き）
+type PointHistoryPage struct {
+	Total  int             `json:"total"`
+	Limit  int             `json:"limit"`
+	Offset int             `json:"offset"`
+	Items  []*PointHistory `json:"items"`
+}
+
+// ユーザーのポイント残高と履歴（管理者向け）
+type AdminUserPointsResponse struct {
+	UserID        int              `json:"user_id"`
+	Username      string           `json:"username"`
+	CurrentPoints int              `json:"current_points"`
+	History       PointHistoryPage `json:"history"`
+}
+
+// ユーザーの顧客生涯価値（管理者向け、完了・出荷済み・一部返金の注文で集計）
+type UserLTVResponse struct {
+	UserID             int        `json:"user_id"`
+	Username           string     `json:"username"`
+	TotalRevenue       int        `json:"total_revenue"`   // 支払額（total_price）の合計
+	RefundedAmount     int        `json:"refunded_amount"` // 一部返金で返した金額の合計（total_revenue からは差し引かない）
+	OrderCount         int        `json:"order_count"`
+	AverageOrderValue  int        `json:"average_order_value"` // total_revenue / order_count（端数切り捨て、注文なしは0）
+	FirstOrderAt       *time.Time `json:"first_order_at"`      // 注文なしは null
+	LastOrderAt        *time.Time `json:"last_order_at"`
+	DaysSinceLastOrder *int       `json:"days_since_last_order"` // 最終注文からの経過日数（24時間単位で切り捨て）
+}
+
+// 在庫一覧（発注判断用、管理者向け）
+type InventoryItem struct {
+	ProductID  int                     `json:"product_id"`
+	Name       string                  `json:"name"`
+	Category   string                  `json:"category"`
+	Warehouses []InventoryWarehouseQty `json:"warehouses"` // 全倉庫分（在庫がない倉庫は0）
+	TotalStock int                     `json:"total_stock"`
+
+	SafetyStock    int `json:"safety_stock"`    // 販売しない安全在庫数
+	AvailableStock int `json:"available_stock"` // 注文可能な在庫数（合計から安全在庫を除いた数）
+}
+
+type InventoryWarehouseQty struct {
+	WarehouseID   int    `json:"warehouse_id"`
+	WarehouseName string `json:"warehouse_name"`
+	Quantity      int    `json:"quantity"`
+}
+
+// ランクアップまでの進捗
+type RankProgressResponse struct {
+	CurrentRank       string `json:"current_rank"`
+	TotalSpent        int    `json:"total_spent_amount"`
+	NextRank          string `json:"next_rank,omitempty"`
+	NextRankThreshold int    `json:"next_rank_threshold,omitempty"`
+	AmountToNextRank  int    `json:"amount_to_next_rank"`
+	ProgressPercent   int    `json:"progress_percent"` // 現在のランク下限から次のランクまでの進捗（%）
+	IsMaxRank         bool   `json:"is_max_rank"`
+}
+
+// 注文した場合の獲得ポイントの見積もり
+type PointsPreviewResponse struct {
+	EarnedPoints      int         `json:"earned_points"`
+	PointsRatePercent int         `json:"points_rate_percent"` // ポイント付与率（最終支払額に対する%）
+	PointsRounding    string      `json:"points_rounding"`     // 端数処理
+	AppliedCoupon     string      `json:"applied_coupon,omitempty"`
+	Totals            OrderTotals `json:"totals"` // 見積もりに使った金額の内訳
+}
+
+// 送料の見積もり
+type ShippingEstimateResponse struct {
+	Subtotal              int  `json:"subtotal"`                // 商品小計（税抜・ランク割引前）
+	SubtotalWithTax       int  `json:"subtotal_with_tax"`       // 送料無料判定に使う税込小計（ランク割引後）
+	ShippingFee           int  `json:"shipping_fee"`            // 送料（クーポン適用前）
+	FreeShipping          bool `json:"free_shipping"`           // 送料無料か
+	FreeShippingByRank    bool `json:"free_shipping_by_rank"`   // ランク特典による送料無料か
+	FreeShippingThreshold int  `json:"free_shipping_threshold"` // 送料無料となる税込小計
+	AmountToFreeShipping  int  `json:"amount_to_free_shipping"` // 送料無料まであといくら（税込、送料無料なら0）
+}
+
+// 実行時に有効な設定（管理者向け、秘密情報は含めない）
+// 期間は time.Duration の文字列表記（例: "30m0s"）で返す
+type AdminConfigResponse struct {
+	TaxRatePercent        int `json:"tax_rate_percent"`
+	PointsRatePercent     int `json:"points_rate_percent"`
+	FreeShippingThreshold int `json:"free_shipping_threshold"`
+	StandardShippingFee   int `json:"standard_shipping_fee"`
+
+	PointsRedemptionRate float64 `json:"points_redemption_rate"`
+
+	PaymentTimeout                 string `json:"payment_timeout"`
+	DefaultWarehouseID             int    `json:"default_warehouse_id"`
+	MaxWishlistSize                int    `json:"max_wishlist_size"`
+	MaxOrderItems                  int    `json:"max_order_items"`
+	SafetyStock                    int    `json:"safety_stock"`
+	PointsExclusionDiscountPercent int    `json:"points_exclusion_discount_percent"`
+	AuthHeader                     string `json:"auth_header"`
+	AllocationStrategy             string `json:"allocation_strategy"`
+	PointsRounding                 string `json:"points_rounding"`
+	DuplicateOrderWindow           string `json:"duplicate_order_window"`
+	LowStockThreshold              int    `json:"low_stock_threshold"`
+	Currency                       string `json:"currency"`
+	MoneyLocale                    string `json:"money_locale"`
+	CurrencyMinorUnits             int    `json:"currency_minor_units"`
+	AllocationFloor                int    `json:"allocation_floor"`
+	MaxDiscountPercent             int    `json:"max_discount_percent"`
+	CancellationWindow             string `json:"cancellation_window"`
+	FailedOrderRetention           string `json:"failed_order_retention"`
+	FailedOrderSweepInterval       string `json:"failed_order_sweep_interval"`
+	FraudHighQuantity              int    `json:"fraud_high_quantity"`
+	FraudLargePointsRedemption     int    `json:"fraud_large_points_redemption"`
+	FraudNewAccountAge             string `json:"fraud_new_account_age"`
+	FraudNewAccountOrderAmount     int    `json:"fraud_new_account_order_amount"`
+	RegisterCheckRateLimit         int    `json:"register_check_rate_limit"`
+	RegisterCheckRateWindow        string `json:"register_check_rate_window"`
+	StaleOrderTimeout              string `json:"stale_order_timeout"`
+	StaleOrderSweepInterval        string `json:"stale_order_sweep_interval"`
+	RecommendWeightWishlist        int    `json:"recommend_weight_wishlist"`
+	RecommendWeightPurchase        int    `json:"recommend_weight_purchase"`
+	RecommendWeightView            int    `json:"recommend_weight_view"`
+	RecommendWeightPopularity      int    `json:"recommend_weight_popularity"`
+	RecommendationLimit            int    `json:"recommendation_limit"`
+}
+
+// 実行時設定の更新リクエスト（指定した項目のみ変更する）
+type UpdateConfigRequest struct {
+	TaxRatePercent                 *int    `json:"tax_rate_percent"`
+	PointsRatePercent              *int    `json:"points_rate_percent"`
+	FreeShippingThreshold          *int    `json:"free_shipping_threshold"`
+	StandardShippingFee            *int    `json:"standard_shipping_fee"`
+	MaxDiscountPercent             *int    `json:"max_discount_percent"`
+	PointsExclusionDiscountPercent *int    `json:"points_exclusion_discount_percent"`
+	MaxOrderItems                  *int    `json:"max_order_items"`
+	MaxWishlistSize                *int    `json:"max_wishlist_size"`
+	LowStockThreshold              *int    `json:"low_stock_threshold"`
+	AllocationStrategy             *string `json:"allocation_strategy"`
+	PointsRounding                 *string `json:"points_rounding"`
+
+	PointsRedemptionRate *float64 `json:"points_redemption_rate"`
+}
+
+// 仮の購入によるランク変化のプレビュー
+type RankPreviewResponse struct {
+	CurrentRank    string `json:"current_rank"`
+	TotalSpent     int    `json:"total_spent_amount"`
+	Amount         int    `json:"amount"`          // 追加で購入する金額
+	ProjectedTotal int    `json:"projected_total"` // 購入後の累計購入金額
+	ProjectedRank  string `json:"projected_rank"`  // 購入後のランク
+	RankChanged    bool   `json:"rank_changed"`
+	NextRank       string `json:"next_rank,omitempty"` // 購入後にさらに上がれるランク
+	AmountToNext   int    `json:"amount_to_next_rank"` // 購入後、次のランクまでに必要な金額
 }
 
 type RecommendedProduct struct {
@@ -137,6 +742,17 @@ type RecommendedProduct struct {
 	Name     string `json:"name"`
 	Price    int    `json:"price"`
 	Category string `json:"category"`
+
+	Score float64 `json:"score"` // おすすめ度（重み付きの親和度と人気度の合計）
+}
+
+// 繰り返し購入している商品
+type FrequentProduct struct {
+	ProductID     int       `json:"product_id"`
+	ProductName   string    `json:"product_name"`   // 最後に注文した時点の商品名
+	OrderCount    int       `json:"order_count"`    // この商品を含む完了注文の件数
+	TotalQuantity int       `json:"total_quantity"` // 完了注文での購入数量の合計
+	LastOrderedAt time.Time `json:"last_ordered_at"`
 }
 
 // ポイント履歴エンティティ
@@ -150,6 +766,102 @@ type PointHistory struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// 在庫監査イベント（在庫調整の記録）
+type StockAuditEvent struct {
+	ID          int       `json:"id"`
+	ProductID   int       `json:"product_id"`
+	WarehouseID int       `json:"warehouse_id"`
+	Delta       int       `json:"delta"`   // 増減数（減少は負の値）
+	Reason      string    `json:"reason"`  // 理由コード
+	Balance     int       `json:"balance"` // 調整後の在庫数
+	UserID      int       `json:"user_id"` // 調整を行った管理者
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// 在庫調整の理由コード
+var validStockAdjustReasons = map[string]bool{
+	"damage":   true, // 破損
+	"theft":    true, // 盗難
+	"miscount": true, // 棚卸差異
+	"restock":  true, // 入荷
+	"other":    true,
+}
+
+// 倉庫ごとの取扱商品（店舗受け取り向け）
+type WarehouseProduct struct {
+	ProductID int    `json:"product_id"`
+	Name      string `json:"name"`
+	Category  string `json:"category"`
+	Price     int    `json:"price"`
+	Quantity  int    `json:"quantity"` // この倉庫の在庫数
+}
+
+// 在庫CSVインポートの行ごとの結果
+type StockImportRowResult struct {
+	Row         int    `json:"row"` // CSV上の行番号（ヘッダーが1行目）
+	ProductID   int    `json:"product_id,omitempty"`
+	WarehouseID int    `json:"warehouse_id,omitempty"`
+	Previous    int    `json:"previous"` // 更新前の在庫数
+	Quantity    int    `json:"quantity"` // 更新後の在庫数
+	Status      string `json:"status"`   // updated / error
+	Error       string `json:"error,omitempty"`
+}
+
+// 在庫CSVインポートのレスポンス
+type StockImportResponse struct {
+	Updated int                    `json:"updated"`
+	Failed  int                    `json:"failed"`
+	Results []StockImportRowResult `json:"results"`
+}
+
+// 一括出荷の1注文分の結果
+type ShipOrderResult struct {
+	OrderID int    `json:"order_id"`
+	Status  string `json:"status"` // shipped / skipped
+	Error   string `json:"error,omitempty"`
+}
+
+// 一括出荷のレスポンス
+type BulkShipResponse struct {
+	Shipped int               `json:"shipped"`
+	Skipped int               `json:"skipped"`
+	Results []ShipOrderResult `json:"results"`
+}
+
+// 出荷待ちの注文（倉庫の作業キュー用）
+type FulfillmentOrder struct {
+	OrderID       int               `json:"order_id"`
+	UserID        int               `json:"user_id"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Items         []OrderItem       `json:"items"`
+	Picks         []FulfillmentPick `json:"picks"` // 倉庫ごとの引当数（倉庫ID・商品ID順）
+	Destination   *GeoPoint         `json:"destination,omitempty"`
+	IsGift        bool              `json:"is_gift,omitempty"`
+	GiftRecipient *GiftRecipient    `json:"gift_recipient,omitempty"`
+}
+
+// 出荷のために倉庫から取り出す商品と数量
+type FulfillmentPick struct {
+	WarehouseID   int    `json:"warehouse_id"`
+	WarehouseName string `json:"warehouse_name,omitempty"`
+	ProductID     int    `json:"product_id"`
+	Quantity      int    `json:"quantity"`
+}
+
+// 在庫CSVインポートのヘッダー
+var stockImportHeader = []string{"product_id", "warehouse_id", "quantity"}
+
+// 注文キャンセルの理由コード
+// 放置された処理中の注文をシステムがキャンセルした場合の理由コード（利用者は指定できない）
+const cancelReasonAbandoned = "abandoned"
+
+var validCancelReasons = map[string]bool{
+	"customer_request": true, // お客様都合
+	"out_of_stock":     true, // 在庫切れ
+	"fraud":            true, // 不正注文
+	"other":            true,
+}
+
 // ユーザー情報レスポンス用構造体
 type UserInfoResponse struct {
 	ID               int    `json:"id"`
@@ -158,6 +870,24 @@ type UserInfoResponse struct {
 	Rank             string `json:"rank"`
 	TotalSpentAmount int    `json:"total_spent_amount"`
 	CurrentPoints    int    `json:"current_points"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// 公開プロフィール（他のユーザーにも見せてよい項目のみ）
+type PublicProfileResponse struct {
+	ID          int       `json:"id"`
+	Username    string    `json:"username"`
+	Rank        string    `json:"rank"`
+	MemberSince time.Time `json:"member_since"`
+}
+
+// 会員特典レスポンス用構造体
+type UserBenefitsResponse struct {
+	Rank          string  `json:"rank"`
+	DiscountRate  float64 `json:"discount_rate"` // ランク割引率（0.05 = 5%）
+	CurrentPoints int     `json:"current_points"`
+	FreeShipping  bool    `json:"free_shipping"` // ランクにより常に送料無料かどうか
 }
 
 // 決済関連の型定義
@@ -168,7 +898,208 @@ type PaymentResult struct {
 }
 
 type PaymentGateway interface {
-	ProcessPayment(amount int, orderID int) PaymentResult
+	ProcessPayment(ctx context.Context, amount, orderID int) PaymentResult
+}
+
+// アプリケーション設定（環境変数で上書き可能）
+type Config struct {
+	PaymentTimeout     time.Duration // 決済ゲートウェイ呼び出しのタイムアウト
+	DefaultWarehouseID int           // 新規商品の初期在庫を配置する倉庫
+	MaxWishlistSize    int           // ユーザーごとのお気に入り登録上限
+	MaxOrderItems      int           // 1注文あたりの明細数の上限
+	SafetyStock        int           // 商品ごとの指定がない場合の安全在庫数（注文可能数から除外）
+	// 割引額（ランク割引＋クーポン）が小計のこの割合（%）を超えた注文にはポイントを付与しない
+	// 0 以下の場合は無効（常に付与）
+	PointsExclusionDiscountPercent int
+	// Authorization ヘッダーがない場合にセッショントークンを読み取るヘッダー名
+	// 空の場合は無効（Authorization ヘッダーのみ）。必要な環境でのみ設定する
+	AuthHeader string
+	// 在庫引当の方針（"split": 複数倉庫に分割可、"no_split": 明細ごとに単一倉庫から出荷）
+	AllocationStrategy string
+	// 付与ポイントの端数処理（"floor": 切り捨て、"round": 四捨五入、"ceil": 切り上げ）
+	PointsRounding string
+	// 同一ユーザーが同じ商品構成の注文をこの期間内に再送した場合は409で拒否する（0で無効）
+	DuplicateOrderWindow time.Duration
+	// 販売レポートで在庫少として報告する倉庫別在庫数のしきい値（以下）
+	LowStockThreshold int
+	// 領収書の金額表示に使う通貨コードとロケール
+	Currency    string
+	MoneyLocale string
+	// 通貨の補助単位の桁数（JPY: 0、USD: 2）。金額はすべて最小単位（円・セント）の整数で扱う
+	CurrencyMinorUnits int
+	// 倉庫ごとの指定がない場合の引当下限（店頭用に残す在庫数、他の倉庫で足りない場合のみ割り込む）
+	AllocationFloor int
+	// 割引合計（カテゴリセール＋ランク割引＋クーポン）の上限。セール前の商品小計に対する%（0以下で無効）
+	MaxDiscountPercent int
+	// 注文作成からキャンセルを受け付ける期間（管理者は期間外でもキャンセル可）
+	CancellationWindow time.Duration
+	// 決済失敗注文をアーカイブへ移すまでの保持期間と、その確認間隔
+	FailedOrderRetention     time.Duration
+	FailedOrderSweepInterval time.Duration
+	// 不正の疑いとして注文にフラグを付けるしきい値（数量・ポイント・金額は0で無効）
+	FraudHighQuantity          int           // 1明細あたりの数量がこれ以上
+	FraudLargePointsRedemption int           // 1注文での使用ポイントがこれ以上
+	FraudNewAccountAge         time.Duration // 登録からこの期間内のアカウントを新規とみなす
+	FraudNewAccountOrderAmount int           // 新規アカウントの注文の支払額がこれ以上
+	// ユーザー名の空き確認の回数制限（クライアントIPごとに期間あたりの回数、0で無効）
+	RegisterCheckRateLimit  int
+	RegisterCheckRateWindow time.Duration
+	// 価格計算の料率（金額は通貨の最小単位、PATCH /admin/config で再起動なしに変更できる）
+	TaxRatePercent        int // 消費税率（%）
+	PointsRatePercent     int // ポイント付与率（最終支払額に対する%）
+	FreeShippingThreshold int // 税込小計がこの金額以上で送料無料
+	StandardShippingFee   int // 通常送料
+	// ポイント利用時の1ポイントあたりの金額（通貨の最小単位、1.0 で 1ポイント = 1円）
+	PointsRedemptionRate float64
+	// 決済処理中（payment_processing）のまま放置された注文をキャンセルするまでの時間と、その確認間隔
+	StaleOrderTimeout       time.Duration
+	StaleOrderSweepInterval time.Duration
+	// おすすめ商品のスコアの重み（お気に入り・購入履歴・閲覧履歴のカテゴリ親和度と人気度、0で無効）と返す件数
+	RecommendWeightWishlist   int
+	RecommendWeightPurchase   int
+	RecommendWeightView       int
+	RecommendWeightPopularity int
+	RecommendationLimit       int
+}
+
+// 在庫引当の方針
+const (
+	allocationSplit   = "split"
+	allocationNoSplit = "no_split"
+)
+
+// 付与ポイントの端数処理
+const (
+	pointsRoundingFloor = "floor"
+	pointsRoundingRound = "round"
+	pointsRoundingCeil  = "ceil"
+)
+
+// 決済処理中のまま放置された注文をキャンセルするまでの時間（STALE_ORDER_TIMEOUT 未指定時）
+const defaultStaleOrderTimeout = 15 * time.Minute
+
+// 実行中の設定。PATCH /admin/config で更新されるため、読み取りは currentConfig() を通す
+var (
+	appConfig = loadConfig()
+	configMux sync.RWMutex
+)
+
+// 現在の設定のスナップショット
+// 1回の計算の途中で設定が変わっても値が混ざらないよう、複数の項目を使う場合は一度だけ取得する
+func currentConfig() Config {
+	configMux.RLock()
+	defer configMux.RUnlock()
+	return appConfig
+}
+
+func loadConfig() Config {
+	cfg := Config{
+		PaymentTimeout:     getEnvDuration("PAYMENT_TIMEOUT", 5*time.Second),
+		DefaultWarehouseID: getEnvInt("DEFAULT_WAREHOUSE_ID", 1),
+		MaxWishlistSize:    getEnvInt("MAX_WISHLIST_SIZE", 100),
+		MaxOrderItems:      getEnvInt("MAX_ORDER_ITEMS", 50),
+		SafetyStock:        getEnvInt("SAFETY_STOCK", 0),
+
+		PointsExclusionDiscountPercent: getEnvInt("POINTS_EXCLUSION_DISCOUNT_PERCENT", 0),
+		AuthHeader:                     getEnvString("AUTH_HEADER", ""),
+		AllocationStrategy:             getEnvString("ALLOCATION_STRATEGY", allocationSplit),
+		PointsRounding:                 getEnvString("POINTS_ROUNDING", pointsRoundingFloor),
+		DuplicateOrderWindow:           getEnvDurationAllowZero("DUPLICATE_ORDER_WINDOW", 0),
+		LowStockThreshold:              getEnvInt("LOW_STOCK_THRESHOLD", 3),
+		Currency:                       getEnvString("CURRENCY", "JPY"),
+		MoneyLocale:                    getEnvString("MONEY_LOCALE", "ja-JP"),
+		CurrencyMinorUnits:             getEnvInt("CURRENCY_MINOR_UNITS", 0),
+		AllocationFloor:                getEnvInt("ALLOCATION_FLOOR", 0),
+		MaxDiscountPercent:             getEnvInt("MAX_DISCOUNT_PERCENT", 0),
+		CancellationWindow:             getEnvDuration("CANCELLATION_WINDOW", 30*time.Minute),
+		FailedOrderRetention:           getEnvDuration("FAILED_ORDER_RETENTION", 7*24*time.Hour),
+		FailedOrderSweepInterval:       getEnvDuration("FAILED_ORDER_SWEEP_INTERVAL", time.Hour),
+		FraudHighQuantity:              getEnvInt("FRAUD_HIGH_QUANTITY", 20),
+		FraudLargePointsRedemption:     getEnvInt("FRAUD_LARGE_POINTS_REDEMPTION", 10000),
+		FraudNewAccountAge:             getEnvDuration("FRAUD_NEW_ACCOUNT_AGE", 24*time.Hour),
+		FraudNewAccountOrderAmount:     getEnvInt("FRAUD_NEW_ACCOUNT_ORDER_AMOUNT", 50000),
+		RegisterCheckRateLimit:         getEnvInt("REGISTER_CHECK_RATE_LIMIT", 10),
+		RegisterCheckRateWindow:        getEnvDuration("REGISTER_CHECK_RATE_WINDOW", time.Minute),
+		TaxRatePercent:                 getEnvInt("TAX_RATE_PERCENT", 10),
+		PointsRatePercent:              getEnvInt("POINTS_RATE_PERCENT", 1),
+		FreeShippingThreshold:          getEnvInt("FREE_SHIPPING_THRESHOLD", 5000),
+		StandardShippingFee:            getEnvInt("STANDARD_SHIPPING_FEE", 500),
+		PointsRedemptionRate:           getEnvPositiveFloat("POINTS_REDEMPTION_RATE", 1.0),
+		StaleOrderTimeout:              getEnvDuration("STALE_ORDER_TIMEOUT", defaultStaleOrderTimeout),
+		StaleOrderSweepInterval:        getEnvDuration("STALE_ORDER_SWEEP_INTERVAL", time.Minute),
+		RecommendWeightWishlist:        getEnvInt("RECOMMEND_WEIGHT_WISHLIST", 3),
+		RecommendWeightPurchase:        getEnvInt("RECOMMEND_WEIGHT_PURCHASE", 2),
+		RecommendWeightView:            getEnvInt("RECOMMEND_WEIGHT_VIEW", 1),
+		RecommendWeightPopularity:      getEnvInt("RECOMMEND_WEIGHT_POPULARITY", 1),
+		RecommendationLimit:            getEnvInt("RECOMMENDATION_LIMIT", 3),
+	}
+
+	// 決済の応答待ちの注文を放置とみなさないよう、放置判定は決済のタイムアウトより長くする
+	if cfg.StaleOrderTimeout <= cfg.PaymentTimeout {
+		fallback := defaultStaleOrderTimeout
+		if fallback <= cfg.PaymentTimeout {
+			fallback = 2 * cfg.PaymentTimeout
+		}
+		log.Printf("STALE_ORDER_TIMEOUT %s must be greater than PAYMENT_TIMEOUT %s, using %s",
+			cfg.StaleOrderTimeout, cfg.PaymentTimeout, fallback)
+		cfg.StaleOrderTimeout = fallback
+	}
+
+	// 未知の引当方針は分割可として扱われてしまうため、設定ミスに気付けるようログに残して既定値を使う
+	if cfg.AllocationStrategy != allocationSplit && cfg.AllocationStrategy != allocationNoSplit {
+		log.Printf("Unknown ALLOCATION_STRATEGY %q (must be %q or %q), using %q",
+			cfg.AllocationStrategy, allocationSplit, allocationNoSplit, allocationSplit)
+		cfg.AllocationStrategy = allocationSplit
+	}
+	return cfg
+}
+
+func getEnvString(key string, defaultValue string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+		log.Printf("Invalid %s value %q, using default %d", key, v, defaultValue)
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Invalid %s value %q, using default %s", key, v, defaultValue)
+	}
+	return defaultValue
+}
+
+func getEnvPositiveFloat(key string, defaultValue float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 && !math.IsInf(f, 0) {
+			return f
+		}
+		log.Printf("Invalid %s value %q, using default %g", key, v, defaultValue)
+	}
+	return defaultValue
+}
+
+// 0 を「無効」として指定できる設定値用
+func getEnvDurationAllowZero(key string, defaultValue time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			return d
+		}
+		log.Printf("Invalid %s value %q, using default %s", key, v, defaultValue)
+	}
+	return defaultValue
 }
 
 // データストア（インメモリ）
@@ -184,6 +1115,45 @@ var (
 	wishlists     = make(map[string]*Wishlist) // key: "userID-productID"
 	pointHistories = make(map[int]*PointHistory)
 
+	// 二次インデックス
+	ordersByTransaction  = make(map[string]int) // key: transactionID, value: orderID
+	productsByExternalID = make(map[string]int) // key: externalID, value: productID（productMux で保護）
+
+	// 監査ログ
+	stockAuditEvents = make(map[int]*StockAuditEvent)
+
+	// ユーザーごとのカート（cartMux で保護）
+	carts   = make(map[int]*Cart) // key: userID
+	cartMux sync.RWMutex
+
+	// 直近の注文内容（重複注文の検出用、recentOrderMux で保護）
+	recentOrders   = make(map[int]recentOrderFingerprint) // key: userID
+	recentOrderMux sync.Mutex
+
+	// ユーザー名の空き確認の回数（registerCheckMux で保護）
+	registerCheckAttempts = make(map[string]*rateLimitWindow) // key: クライアントIP
+	registerCheckMux      sync.Mutex
+
+	// 最近閲覧した商品（おすすめ商品の選定用、recentViewMux で保護）
+	recentViews   = make(map[int][]int) // key: userID, value: productID（古い順）
+	recentViewMux sync.Mutex
+
+	// アーカイブ済みの決済失敗注文（orderMux で保護、集計対象外・監査用に保持）
+	archivedOrders []*Order
+
+	// セッション発行日時（sessionMux で保護）
+	sessionCreatedAt = make(map[string]time.Time) // key: token
+
+	// カテゴリセール（categorySaleMux で保護）
+	categorySales      = make(map[int]*CategorySale)
+	nextCategorySaleID = 1
+	categorySaleMux    sync.RWMutex
+
+	// 購入金額特典（giftRuleMux で保護）
+	giftRules      = make(map[int]*GiftRule)
+	nextGiftRuleID = 1
+	giftRuleMux    sync.RWMutex
+
 	productMux      sync.RWMutex
 	warehouseMux    sync.RWMutex
 	stockMux        sync.RWMutex
@@ -193,18 +1163,29 @@ var (
 	couponMux       sync.RWMutex
 	wishlistMux     sync.RWMutex
 	pointHistoryMux sync.RWMutex
+	stockAuditMux   sync.RWMutex
 
 	nextProductID      = 1
 	nextWarehouseID    = 1
 	nextUserID         = 1
 	nextOrderID        = 1
 	nextPointHistoryID = 1
+	nextStockAuditID   = 1
 )
 
 // ダミー決済ゲートウェイの実装
 type DummyPaymentGateway struct{}
 
-func (d *DummyPaymentGateway) ProcessPayment(amount int, orderID int) PaymentResult {
+func (d *DummyPaymentGateway) ProcessPayment(ctx context.Context, amount, orderID int) PaymentResult {
+	// キャンセル済みのリクエストは処理しない
+	if err := ctx.Err(); err != nil {
+		return PaymentResult{
+			Success:       false,
+			TransactionID: "",
+			Message:       "Payment cancelled",
+		}
+	}
+
 	// 90%の確率で成功するようにシミュレート
 	rand.Seed(time.Now().UnixNano())
 	success := rand.Float64() < 0.9
@@ -238,6 +1219,31 @@ func (d *DummyPaymentGateway) ProcessPayment(amount int, orderID int) PaymentRes
 // グローバルな決済ゲートウェイインスタンス
 var paymentGateway PaymentGateway = &DummyPaymentGateway{}
 
+// タイムアウト（呼び出し側の設定の PAYMENT_TIMEOUT）付きで決済を実行する
+// タイムアウトまたは親コンテキストのキャンセル時は ctx.Err() を返し、ゲートウェイの結果は破棄する
+func processPaymentWithTimeout(parent context.Context, timeout time.Duration, amount, orderID int) (PaymentResult, error) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	// 既にキャンセルされている場合はゲートウェイを呼び出さない
+	if err := ctx.Err(); err != nil {
+		return PaymentResult{Success: false, Message: "Payment cancelled"}, err
+	}
+
+	gateway := paymentGateway
+	resultCh := make(chan PaymentResult, 1)
+	go func() {
+		resultCh <- gateway.ProcessPayment(ctx, amount, orderID)
+	}()
+
+	select {
+	case result := <-resultCh:
+		return result, nil
+	case <-ctx.Done():
+		return PaymentResult{Success: false, Message: "Payment timed out"}, ctx.Err()
+	}
+}
+
 // 初期データ
 func init() {
 	// 管理者ユーザーを作成
@@ -250,15 +1256,16 @@ func init() {
 		CurrentPoints:    0,
 		TotalSpentAmount: 0,
 		MemberRank:       "Normal",
+		CreatedAt:        time.Now(),
 	}
 	users[admin.ID] = admin
 	usersByName[admin.Username] = admin
 	nextUserID++
 
 	// 倉庫を作成
-	warehouses[1] = &Warehouse{ID: 1, Name: "東京倉庫"}
-	warehouses[2] = &Warehouse{ID: 2, Name: "大阪倉庫"}
-	warehouses[3] = &Warehouse{ID: 3, Name: "福岡倉庫"}
+	warehouses[1] = &Warehouse{ID: 1, Name: "東京倉庫", Latitude: 35.6812, Longitude: 139.7671}
+	warehouses[2] = &Warehouse{ID: 2, Name: "大阪倉庫", Latitude: 34.7025, Longitude: 135.4959}
+	warehouses[3] = &Warehouse{ID: 3, Name: "福岡倉庫", Latitude: 33.5902, Longitude: 130.4207}
 	nextWarehouseID = 4
 
 	// サンプル商品を追加
@@ -321,23 +1328,60 @@ func init() {
 		Amount:      2000,
 		Description: "2000円割引クーポン",
 	}
+	coupons["FREESHIP"] = &Coupon{
+		Code:        "FREESHIP",
+		Type:        "shipping",
+		Amount:      100,
+		Description: "送料無料クーポン",
+	}
 }
 
 // ユーティリティ関数
-var tokenCounter int
 
+// セッショントークンのバイト長
+const tokenByteLength = 32
+
+// 暗号論的乱数から推測不能なトークンを生成する（ユーザー情報は含めない）
 func generateToken() string {
-	tokenCounter++
-	return fmt.Sprintf("token_%d_%d_%d", time.Now().UnixNano(), nextUserID, tokenCounter)
+	b := make([]byte, tokenByteLength)
+	if _, err := crand.Read(b); err != nil {
+		// 乱数生成に失敗した場合は安全なトークンを発行できないため続行しない
+		panic(fmt.Sprintf("failed to generate session token: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// 新しいセッションを発行し、トークンを返す
+func createSession(user *User) string {
+	token := generateToken()
+	sessionMux.Lock()
+	sessions[token] = user
+	sessionCreatedAt[token] = time.Now()
+	sessionMux.Unlock()
+	return token
+}
+
+// 監査表示用にトークンを先頭数文字のみにマスクする
+func maskToken(token string) string {
+	const visible = 6
+	if len(token) <= visible {
+		return strings.Repeat("*", len(token))
+	}
+	return token[:visible] + "..."
 }
 
 func getAuthUser(r *http.Request) *User {
 	token := r.Header.Get("Authorization")
+	if token != "" {
+		token = strings.TrimPrefix(token, "Bearer ")
+	} else if header := currentConfig().AuthHeader; header != "" {
+		// Authorization を除去するゲートウェイ経由のクライアント向けの代替ヘッダー
+		token = r.Header.Get(header)
+	}
 	if token == "" {
 		return nil
 	}
 
-	token = strings.TrimPrefix(token, "Bearer ")
 	sessionMux.RLock()
 	user := sessions[token]
 	sessionMux.RUnlock()
@@ -351,15 +1395,61 @@ func jsonResponse(w http.ResponseWriter, status int, data interface{}) {
 	json.NewEncoder(w).Encode(data)
 }
 
+// 共有データを保護するロックの保持中に応答用の JSON に変換する
+// （ロック解放後に他のリクエストが更新しても、変換中のデータを読まないようにする）
+func lockedJSON(data interface{}) json.RawMessage {
+	body, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Failed to encode response: %v", err)
+		return json.RawMessage("null")
+	}
+	return body
+}
+
 func errorResponse(w http.ResponseWriter, status int, message string) {
 	jsonResponse(w, status, map[string]string{"error": message})
 }
 
-// 在庫管理ヘルパー関数
+// リクエストボディのJSONを読み取る
+// 失敗時はクライアント向けのメッセージ（構文エラーの位置、型が合わないフィールド名など）をエラーとして返す
+func decodeJSONBody(r *http.Request, v interface{}) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return errors.New("Invalid request body")
+	}
+
+	err = json.Unmarshal(body, v)
+	if err == nil {
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("Malformed JSON at byte %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return fmt.Errorf("Invalid value for field %q: expected %s, got %s", typeErr.Field, typeErr.Type.String(), typeErr.Value)
+	case errors.As(err, &typeErr):
+		return errors.New("Request body must be a JSON object")
+	default:
+		return errors.New("Invalid request body")
+	}
+}
+
+// エラーレスポンス（クライアントが判別できるエラーコード付き）
+func errorResponseWithCode(w http.ResponseWriter, status int, code string, message string) {
+	jsonResponse(w, status, map[string]string{"error": message, "code": code})
+}
+
+// 在庫管理ヘルパー関数
 func getProductStock(productID int) (totalStock int, stockDetails []StockWarehouse) {
 	stockMux.RLock()
 	defer stockMux.RUnlock()
 
+	// 在庫がない場合も JSON で null ではなく [] になるように空スライスで初期化
+	stockDetails = []StockWarehouse{}
+
 	for _, stock := range stocks {
 		if stock.ProductID == productID && stock.Quantity > 0 {
 			warehouseMux.RLock()
@@ -378,509 +1468,5833 @@ func getProductStock(productID int) (totalStock int, stockDetails []StockWarehou
 	return
 }
 
-// 在庫を引き当てる関数
-func allocateStock(productID int, requiredQuantity int) (allocated bool, allocations map[int]int) {
-	allocations = make(map[int]int)
-	remaining := requiredQuantity
+// 商品の安全在庫数（商品ごとの指定がなければ全体設定）
+func safetyStockFor(cfg Config, p *Product) int {
+	if p.SafetyStock > 0 {
+		return p.SafetyStock
+	}
+	if cfg.SafetyStock > 0 {
+		return cfg.SafetyStock
+	}
+	return 0
+}
 
-	// まず在庫を確認
-	stockMux.RLock()
-	var availableStocks []*Stock
-	for _, stock := range stocks {
-		if stock.ProductID == productID && stock.Quantity > 0 {
-			availableStocks = append(availableStocks, stock)
-		}
+// 倉庫の引当下限（倉庫ごとの指定がなければ全体設定）
+// 呼び出し側で warehouseMux を保持していること
+func allocationFloorFor(cfg Config, w *Warehouse) int {
+	if w != nil && w.AllocationFloor > 0 {
+		return w.AllocationFloor
 	}
-	stockMux.RUnlock()
+	if cfg.AllocationFloor > 0 {
+		return cfg.AllocationFloor
+	}
+	return 0
+}
 
-	// 在庫が存在する倉庫から順に引き当て
-	for _, stock := range availableStocks {
-		if remaining <= 0 {
-			break
-		}
+// 安全在庫を除いた注文可能な在庫数
+func sellableStock(cfg Config, p *Product, totalStock int) int {
+	if available := totalStock - safetyStockFor(cfg, p); available > 0 {
+		return available
+	}
+	return 0
+}
 
-		if stock.Quantity >= remaining {
-			allocations[stock.WarehouseID] = remaining
-			remaining = 0
-		} else {
-			allocations[stock.WarehouseID] = stock.Quantity
-			remaining -= stock.Quantity
+// 注文数量に応じた単価（適用できる段階価格のうち最も安いもの、なければ通常価格）
+func unitPriceFor(p *Product, quantity int) int {
+	price := p.Price
+	for _, tier := range p.PriceTiers {
+		if quantity >= tier.MinQty && tier.UnitPrice < price {
+			price = tier.UnitPrice
 		}
 	}
+	return price
+}
 
-	// 全数量を確保できた場合のみ実際に在庫を減らす
-	if remaining == 0 {
-		stockMux.Lock()
-		for warehouseID, quantity := range allocations {
-			key := fmt.Sprintf("%d-%d", productID, warehouseID)
-			if stock, exists := stocks[key]; exists {
-				stock.Quantity -= quantity
-			}
+// 現在有効なカテゴリセールの割引率（カテゴリ -> %）
+// 同じカテゴリに複数のセールが重なる場合は割引率の大きい方を適用する
+func activeCategorySales(now time.Time) map[string]int {
+	categorySaleMux.RLock()
+	defer categorySaleMux.RUnlock()
+
+	rates := make(map[string]int)
+	for _, sale := range categorySales {
+		if now.Before(sale.ValidFrom) || !now.Before(sale.ValidUntil) {
+			continue
+		}
+		if sale.PercentOff > rates[sale.Category] {
+			rates[sale.Category] = sale.PercentOff
 		}
-		stockMux.Unlock()
-		return true, allocations
 	}
-
-	return false, nil
+	return rates
 }
 
-// クーポン割引計算ヘルパー関数
-func calculateCouponDiscount(coupon *Coupon, baseAmount int) int {
-	if coupon == nil {
+// カテゴリセールによる明細の割引額（セール対象外なら0）
+// 単価ごとではなく明細の小計に対して1回だけ計算し、端数処理は percentOfAmount に従う
+func saleDiscountFor(cfg Config, p *Product, quantity int, sales map[string]int) int {
+	percent := sales[p.Category]
+	if percent <= 0 {
 		return 0
 	}
+	return percentOfAmount(cfg, unitPriceFor(p, quantity)*quantity, percent)
+}
 
-	var discount int
-	switch coupon.Type {
-	case "fixed":
-		discount = coupon.Amount
-	case "percentage":
-		discount = baseAmount * coupon.Amount / 100
-	default:
-		return 0
+// 注文明細の金額（注文時点の単価×数量からカテゴリセールの割引を引いたもの）
+func orderItemTotal(item OrderItem) int {
+	return item.UnitPrice*item.Quantity - item.SaleDiscount
+}
+
+var (
+	errWarehouseNotFound         = errors.New("warehouse not found")
+	errWarehouseCapacityExceeded = errors.New("warehouse capacity exceeded")
+)
+
+// 初期在庫を倉庫に配置する
+// 倉庫の存在確認・容量の確認と在庫の書き込みを stockMux の保持中に行い、
+// 存在しない倉庫への在庫（getProductStock から見えない在庫）や容量を超える在庫を作らない
+func placeInitialStock(productID, warehouseID, quantity int) error {
+	stockMux.Lock()
+	defer stockMux.Unlock()
+
+	warehouseMux.RLock()
+	warehouse := warehouses[warehouseID]
+	warehouseMux.RUnlock()
+	if warehouse == nil {
+		return errWarehouseNotFound
+	}
+	if exceedsWarehouseCapacity(warehouse, warehouseStockTotal(warehouseID)+quantity) {
+		return errWarehouseCapacityExceeded
 	}
 
-	// 割引額が元の金額を超えないようにする
-	if discount > baseAmount {
-		discount = baseAmount
+	key := fmt.Sprintf("%d-%d", productID, warehouseID)
+	stocks[key] = &Stock{
+		ProductID:   productID,
+		WarehouseID: warehouseID,
+		Quantity:    quantity,
 	}
+	return nil
+}
 
-	return discount
+// 倉庫に保管されている在庫数の合計（呼び出し側で stockMux をロックしていること）
+func warehouseStockTotal(warehouseID int) int {
+	total := 0
+	for _, stock := range stocks {
+		if stock.WarehouseID == warehouseID {
+			total += stock.Quantity
+		}
+	}
+	return total
 }
 
-// 販売分析レポート集計関数
-func generateSalesReport() *SalesReportResponse {
-	report := &SalesReportResponse{}
+// 倉庫の在庫合計が newTotal になった場合に容量を超えるか
+func exceedsWarehouseCapacity(warehouse *Warehouse, newTotal int) bool {
+	return warehouse.Capacity > 0 && newTotal > warehouse.Capacity
+}
 
-	// 1. 販売サマリーの集計
-	orderMux.RLock()
-	totalRevenue := 0
-	completedOrders := 0
-	couponUsedOrders := 0
-	totalOrdersForCouponRate := 0
-	productQuantities := make(map[int]int) // productID -> total quantity
+// 販売開始前の予約商品か
+func isPreOrder(p *Product) bool {
+	return !p.AvailableFrom.IsZero() && time.Now().Before(p.AvailableFrom)
+}
 
-	for _, order := range orders {
-		// クーポン利用率の計算用（全注文をカウント）
-		if order.Status == "completed" || order.Status == "payment_failed" {
-			totalOrdersForCouponRate++
-			if order.AppliedCoupon != "" {
-				couponUsedOrders++
-			}
+// レスポンス用の販売開始日時（未設定の場合は nil）
+func availableFromPtr(p *Product) *time.Time {
+	if p.AvailableFrom.IsZero() {
+		return nil
+	}
+	t := p.AvailableFrom
+	return &t
+}
+
+// 注文明細ごとの在庫有無を確認する（在庫の引当・減算は行わない）
+// 結果は items と同じ順序で返す（全明細を同じ設定 cfg で判定する）
+func checkStockAvailability(cfg Config, items []OrderItem) []StockAvailability {
+	result := make([]StockAvailability, len(items))
+	for i, item := range items {
+		result[i] = StockAvailability{
+			ProductID: item.ProductID,
+			Requested: item.Quantity,
 		}
 
-		// 売上とランキングは完了した注文のみ
-		if order.Status == "completed" {
-			totalRevenue += order.TotalPrice
-			completedOrders++
+		productMux.RLock()
+		product := products[item.ProductID]
+		productMux.RUnlock()
+		if product == nil {
+			continue
+		}
 
-			// 商品ごとの販売数量を集計
-			for _, item := range order.Items {
-				productQuantities[item.ProductID] += item.Quantity
+		totalStock, stockDetails := getProductStock(product.ID)
+		result[i].Name = product.Name
+		result[i].Found = true
+		result[i].Available = sellableStock(cfg, product, totalStock)
+
+		// 分割出荷しない場合は、単一倉庫の最大在庫数が引当可能数（安全在庫を除いた数が上限）
+		if cfg.AllocationStrategy == allocationNoSplit {
+			maxSingle := 0
+			for _, detail := range stockDetails {
+				if detail.Quantity > maxSingle {
+					maxSingle = detail.Quantity
+				}
+			}
+			if maxSingle < result[i].Available {
+				result[i].Available = maxSingle
 			}
 		}
+		result[i].Sufficient = result[i].Available >= item.Quantity
 	}
-	orderMux.RUnlock()
+	return result
+}
 
-	report.SalesSummary = SalesSummary{
-		TotalRevenue: totalRevenue,
-		TotalOrders:  completedOrders,
-	}
+// 郵便番号の先頭1桁ごとの代表地点（配送先の緯度・経度が指定されない場合の近似に使う）
+var postalRegionPoints = map[byte]GeoPoint{
+	'0': {Latitude: 43.0642, Longitude: 141.3469}, // 北海道
+	'1': {Latitude: 35.6812, Longitude: 139.7671}, // 東京
+	'2': {Latitude: 35.4437, Longitude: 139.6380}, // 神奈川・千葉
+	'3': {Latitude: 35.8617, Longitude: 139.6455}, // 埼玉・北関東
+	'4': {Latitude: 35.1815, Longitude: 136.9066}, // 東海
+	'5': {Latitude: 34.6937, Longitude: 135.5023}, // 大阪・近畿
+	'6': {Latitude: 35.0116, Longitude: 135.7681}, // 京都・兵庫
+	'7': {Latitude: 34.3853, Longitude: 132.4553}, // 中国・四国
+	'8': {Latitude: 33.5904, Longitude: 130.4017}, // 九州・沖縄
+	'9': {Latitude: 38.2682, Longitude: 140.8694}, // 東北・北陸
+}
 
-	// 2. 人気商品ランキング（トップ3）
-	type productQty struct {
-		ID       int
-		Name     string
-		Quantity int
-	}
-	var rankings []productQty
+// ギフト注文の入力の上限（文字数）
+const (
+	maxGiftRecipientNameLength = 100
+	maxGiftAddressLength       = 300
+	maxGiftMessageLength       = 500
+)
 
-	productMux.RLock()
-	for productID, qty := range productQuantities {
-		if product, exists := products[productID]; exists {
-			rankings = append(rankings, productQty{
-				ID:       productID,
-				Name:     product.Name,
-				Quantity: qty,
-			})
+// ギフト注文の受取人とメッセージを検証する（前後の空白は取り除いて返す）
+// is_gift でない注文に受取人・メッセージが指定された場合もエラーにする
+func validateGiftOrder(req CreateOrderRequest) (*GiftRecipient, string, error) {
+	message := strings.TrimSpace(req.GiftMessage)
+	if !req.IsGift {
+		if req.GiftRecipient != nil || message != "" {
+			return nil, "", errors.New("gift_recipient and gift_message require is_gift")
 		}
+		return nil, "", nil
 	}
-	productMux.RUnlock()
 
-	// 販売数量でソート（降順）
-	for i := 0; i < len(rankings); i++ {
-		for j := i + 1; j < len(rankings); j++ {
-			if rankings[j].Quantity > rankings[i].Quantity {
-				rankings[i], rankings[j] = rankings[j], rankings[i]
-			}
-		}
+	if req.GiftRecipient == nil {
+		return nil, "", errors.New("gift_recipient is required for gift orders")
 	}
-
-	// トップ3を取得
-	topProducts := []ProductRanking{}
-	for i := 0; i < len(rankings) && i < 3; i++ {
-		topProducts = append(topProducts, ProductRanking{
-			ProductName:   rankings[i].Name,
-			TotalQuantity: rankings[i].Quantity,
-		})
+	recipient := &GiftRecipient{
+		Name:    strings.TrimSpace(req.GiftRecipient.Name),
+		Address: strings.TrimSpace(req.GiftRecipient.Address),
 	}
-	report.TopProducts = topProducts
+	if recipient.Name == "" {
+		return nil, "", errors.New("gift_recipient.name is required")
+	}
+	if recipient.Address == "" {
+		return nil, "", errors.New("gift_recipient.address is required")
+	}
+	if utf8.RuneCountInString(recipient.Name) > maxGiftRecipientNameLength {
+		return nil, "", fmt.Errorf("gift_recipient.name must be at most %d characters", maxGiftRecipientNameLength)
+	}
+	if utf8.RuneCountInString(recipient.Address) > maxGiftAddressLength {
+		return nil, "", fmt.Errorf("gift_recipient.address must be at most %d characters", maxGiftAddressLength)
+	}
+	if utf8.RuneCountInString(message) > maxGiftMessageLength {
+		return nil, "", fmt.Errorf("gift_message must be at most %d characters", maxGiftMessageLength)
+	}
+	return recipient, message, nil
+}
 
-	// 3. 倉庫別在庫サマリー
-	warehouseStocks := make(map[int]int) // warehouseID -> total stock
-	stockMux.RLock()
-	for _, stock := range stocks {
-		if stock.Quantity > 0 {
-			warehouseStocks[stock.WarehouseID] += stock.Quantity
+// 注文の配送先を地点に変換する（指定なしは nil）
+// 緯度・経度が指定されていればそれを使い、なければ郵便番号の地域から近似する
+func resolveDestination(latitude, longitude float64, postalCode string) (*GeoPoint, error) {
+	if latitude != 0 || longitude != 0 {
+		if latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+			return nil, fmt.Errorf("Invalid destination coordinates")
 		}
+		return &GeoPoint{Latitude: latitude, Longitude: longitude}, nil
 	}
-	stockMux.RUnlock()
+	if postalCode == "" {
+		return nil, nil
+	}
+	point, ok := postalRegionPoints[postalCode[0]]
+	if !ok {
+		return nil, fmt.Errorf("Unknown postal code: %s", postalCode)
+	}
+	return &point, nil
+}
+
+// 2地点間の大圏距離（km、ハバーサイン公式）
+func greatCircleDistanceKm(a, b GeoPoint) float64 {
+	const earthRadiusKm = 6371.0
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
 
-	var warehouseInventory []WarehouseInventoryStat
+// 在庫を配送先に近い倉庫の順に並べる（位置未設定の倉庫は最後、同距離は倉庫ID順）
+func sortStocksByDistance(stockList []*Stock, dest *GeoPoint) {
+	distances := make(map[int]float64)
 	warehouseMux.RLock()
-	for warehouseID, totalStock := range warehouseStocks {
-		if warehouse, exists := warehouses[warehouseID]; exists {
-			warehouseInventory = append(warehouseInventory, WarehouseInventoryStat{
-				WarehouseName: warehouse.Name,
-				TotalStock:    totalStock,
-			})
+	for _, stock := range stockList {
+		warehouse := warehouses[stock.WarehouseID]
+		if warehouse == nil || (warehouse.Latitude == 0 && warehouse.Longitude == 0) {
+			distances[stock.WarehouseID] = math.Inf(1)
+			continue
 		}
+		distances[stock.WarehouseID] = greatCircleDistanceKm(*dest, GeoPoint{Latitude: warehouse.Latitude, Longitude: warehouse.Longitude})
 	}
 	warehouseMux.RUnlock()
 
-	// 倉庫名でソート（安定した出力のため）
-	for i := 0; i < len(warehouseInventory); i++ {
-		for j := i + 1; j < len(warehouseInventory); j++ {
-			if warehouseInventory[j].WarehouseName < warehouseInventory[i].WarehouseName {
-				warehouseInventory[i], warehouseInventory[j] = warehouseInventory[j], warehouseInventory[i]
-			}
+	sort.Slice(stockList, func(i, j int) bool {
+		di, dj := distances[stockList[i].WarehouseID], distances[stockList[j].WarehouseID]
+		if di != dj {
+			return di < dj
 		}
-	}
-	report.WarehouseInventory = warehouseInventory
+		return stockList[i].WarehouseID < stockList[j].WarehouseID
+	})
+}
 
-	// 4. プロモーション効果分析
-	couponUsageRate := 0.0
-	if totalOrdersForCouponRate > 0 {
-		couponUsageRate = float64(couponUsedOrders) / float64(totalOrdersForCouponRate) * 100
-	}
-	report.PromotionAnalysis = PromotionAnalysis{
-		CouponUsageRate: couponUsageRate,
-	}
+// 在庫の確定時に他の注文と競合した場合に引当をやり直す回数
+// やり直しても競合が続く場合は、在庫の書き込みロックを保持したまま引き当てる（allocateStockLocked）
+const maxAllocationAttempts = 5
 
-	return report
+// 在庫を引き当てる関数
+// 配送先（dest）が指定されている場合は近い倉庫から順に引き当てる
+// 在庫を読んでから減らすまでの間に他の注文が同じ倉庫の在庫を変更した場合は、
+// 確定をやり直す（compare-and-set）。やり直しても競合が続く場合は書き込みロックの中で引き当てる
+// （在庫が足りているのに競合だけで引当失敗にしない）
+func allocateStock(cfg Config, productID int, requiredQuantity int, dest *GeoPoint) (allocated bool, allocations map[int]int) {
+	for attempt := 0; attempt < maxAllocationAttempts; attempt++ {
+		planned, observed, ok := planStockAllocation(cfg, productID, requiredQuantity, dest)
+		if !ok {
+			return false, nil
+		}
+		if commitStockAllocation(productID, planned, observed) {
+			return true, planned
+		}
+	}
+	log.Printf("Stock allocation for product %d conflicted %d times, allocating under the stock lock", productID, maxAllocationAttempts)
+	return allocateStockLocked(cfg, productID, requiredQuantity, dest)
 }
 
-// お気に入り関連のヘルパー関数
-func isProductInWishlist(userID int, productID int) bool {
-	key := fmt.Sprintf("%d-%d", userID, productID)
-	wishlistMux.RLock()
-	defer wishlistMux.RUnlock()
-	_, exists := wishlists[key]
-	return exists
-}
+// 在庫の書き込みロックを保持したまま計画と確定を行う（競合しないが、その間は他の在庫操作を待たせる）
+func allocateStockLocked(cfg Config, productID int, requiredQuantity int, dest *GeoPoint) (bool, map[int]int) {
+	safetyStock := productSafetyStock(cfg, productID)
 
-func addToWishlist(userID int, productID int) bool {
-	key := fmt.Sprintf("%d-%d", userID, productID)
-	wishlistMux.Lock()
-	defer wishlistMux.Unlock()
+	stockMux.Lock()
+	defer stockMux.Unlock()
 
-	if _, exists := wishlists[key]; exists {
-		return false // 既に登録済み
+	availableStocks, _ := snapshotProductStocks(productID)
+	allocations, ok := planAllocationFromStocks(cfg, availableStocks, requiredQuantity, safetyStock, dest)
+	if !ok {
+		return false, nil
 	}
-
-	wishlists[key] = &Wishlist{
-		UserID:    userID,
-		ProductID: productID,
+	for warehouseID, quantity := range allocations {
+		stocks[fmt.Sprintf("%d-%d", productID, warehouseID)].Quantity -= quantity
 	}
-	return true
+	return true, allocations
 }
 
-func removeFromWishlist(userID int, productID int) bool {
-	key := fmt.Sprintf("%d-%d", userID, productID)
-	wishlistMux.Lock()
-	defer wishlistMux.Unlock()
-
-	if _, exists := wishlists[key]; !exists {
-		return false // 存在しない
+// 商品の安全在庫数（商品が存在しなければ0）
+func productSafetyStock(cfg Config, productID int) int {
+	productMux.RLock()
+	defer productMux.RUnlock()
+	if product := products[productID]; product != nil {
+		return safetyStockFor(cfg, product)
 	}
+	return 0
+}
 
-	delete(wishlists, key)
-	return true
+// 商品の在庫（数量が正の倉庫のみ）のコピーと倉庫ごとの在庫数を返す
+// 呼び出し側で stockMux をロックしていること
+func snapshotProductStocks(productID int) ([]*Stock, map[int]int) {
+	var availableStocks []*Stock
+	observed := make(map[int]int)
+	for _, stock := range stocks {
+		if stock.ProductID == productID && stock.Quantity > 0 {
+			snapshot := *stock
+			availableStocks = append(availableStocks, &snapshot)
+			observed[stock.WarehouseID] = stock.Quantity
+		}
+	}
+	return availableStocks, observed
 }
 
-func getUserWishlistCategories(userID int) map[string]bool {
-	categories := make(map[string]bool)
-	wishlistMux.RLock()
-	defer wishlistMux.RUnlock()
+// 在庫のスナップショットから倉庫ごとの引当数を決める（在庫はまだ減らさない）
+// observed は計画に使った倉庫ごとの在庫数で、確定時の比較に使う
+func planStockAllocation(cfg Config, productID int, requiredQuantity int, dest *GeoPoint) (allocations map[int]int, observed map[int]int, ok bool) {
+	// 安全在庫分は引き当てない
+	safetyStock := productSafetyStock(cfg, productID)
 
-	for _, wishlist := range wishlists {
-		// wishlists キーの形式を確認し、ユーザーIDが一致するものを選択
-		if wishlist != nil && wishlist.UserID == userID {
-			productMux.RLock()
-			if product, exists := products[wishlist.ProductID]; exists {
-				categories[product.Category] = true
-			}
-			productMux.RUnlock()
-		}
+	// まず在庫を確認（ロックを外した後に値が変わらないようコピーを使う）
+	stockMux.RLock()
+	availableStocks, observed := snapshotProductStocks(productID)
+	stockMux.RUnlock()
+
+	allocations, ok = planAllocationFromStocks(cfg, availableStocks, requiredQuantity, safetyStock, dest)
+	if !ok {
+		return nil, nil, false
 	}
-	return categories
+	return allocations, observed, true
 }
 
-func getRecommendations(userID int) []RecommendedProduct {
-	// ユーザーのお気に入りカテゴリを取得
-	favoriteCategories := getUserWishlistCategories(userID)
-	if len(favoriteCategories) == 0 {
-		return []RecommendedProduct{}
+// 在庫のコピーから倉庫ごとの引当数を決める（安全在庫・倉庫の引当下限・引当方式を考慮する）
+func planAllocationFromStocks(cfg Config, availableStocks []*Stock, requiredQuantity, safetyStock int, dest *GeoPoint) (map[int]int, bool) {
+	allocations := make(map[int]int)
+	remaining := requiredQuantity
+
+	totalStock := 0
+	for _, stock := range availableStocks {
+		totalStock += stock.Quantity
+	}
+	if totalStock-safetyStock < requiredQuantity {
+		return nil, false
 	}
 
-	// ユーザーのお気に入り商品IDを取得
-	wishlistMux.RLock()
-	userFavorites := make(map[int]bool)
-	for _, wishlist := range wishlists {
-		// キーの形式を確認し、ユーザーIDが一致するものを選択
-		if wishlist != nil && wishlist.UserID == userID {
-			userFavorites[wishlist.ProductID] = true
-		}
+	// 配送先が指定されている場合は近い倉庫を優先する
+	if dest != nil {
+		sortStocksByDistance(availableStocks, dest)
 	}
-	wishlistMux.RUnlock()
 
-	// おすすめ商品を選定
-	recommendations := []RecommendedProduct{}
-	productMux.RLock()
-	defer productMux.RUnlock()
+	// 倉庫ごとの引当下限（店頭用に残す在庫数）
+	floors := make(map[int]int)
+	warehouseMux.RLock()
+	for _, stock := range availableStocks {
+		floors[stock.WarehouseID] = allocationFloorFor(cfg, warehouses[stock.WarehouseID])
+	}
+	warehouseMux.RUnlock()
 
-	for _, product := range products {
-		// カテゴリが一致し、まだお気に入りでない商品を選定
-		if favoriteCategories[product.Category] && !userFavorites[product.ID] {
-			recommendations = append(recommendations, RecommendedProduct{
-				ID:       product.ID,
-				Name:     product.Name,
-				Price:    product.Price,
-				Category: product.Category,
-			})
-			// 最大3件まで
-			if len(recommendations) >= 3 {
+	if cfg.AllocationStrategy == allocationNoSplit {
+		// 分割出荷しない場合は、単独で全数量を満たせる倉庫から引き当て
+		// （配送先があれば最も近い倉庫、なければ ID が最小の倉庫）
+		// 引当下限を割り込まずに満たせる倉庫を優先し、なければ下限を割り込んでよい
+		var chosen *Stock
+		for _, honorFloor := range []bool{true, false} {
+			for _, stock := range availableStocks {
+				usable := stock.Quantity
+				if honorFloor {
+					usable -= floors[stock.WarehouseID]
+				}
+				if usable < requiredQuantity {
+					continue
+				}
+				if chosen == nil || (dest == nil && stock.WarehouseID < chosen.WarehouseID) {
+					chosen = stock
+				}
+			}
+			if chosen != nil {
 				break
 			}
 		}
+		if chosen == nil {
+			return nil, false
+		}
+		availableStocks = []*Stock{chosen}
 	}
 
-	return recommendations
-}
+	// 在庫が存在する倉庫から順に引き当て
+	// まず各倉庫の引当下限を超える分だけを使い、それで足りない場合のみ下限を割り込んで引き当てる
+	for _, honorFloor := range []bool{true, false} {
+		for _, stock := range availableStocks {
+			if remaining <= 0 {
+				break
+			}
 
-// 会員ランク判定ヘルパー関数
-func calculateMemberRank(totalSpent int) string {
-	if totalSpent >= 100000 {
-		return "Gold"
-	} else if totalSpent >= 50000 {
-		return "Silver"
-	} else {
-		return "Normal"
+			usable := stock.Quantity - allocations[stock.WarehouseID]
+			if honorFloor {
+				usable -= floors[stock.WarehouseID]
+			}
+			if usable <= 0 {
+				continue
+			}
+			if usable > remaining {
+				usable = remaining
+			}
+			allocations[stock.WarehouseID] += usable
+			remaining -= usable
+		}
+	}
+
+	if remaining > 0 {
+		return nil, false
 	}
+	return allocations, true
 }
 
-// ランクによる割引率を取得
-func getRankDiscountRate(rank string) float64 {
-	switch rank {
-	case "Gold":
-		return 0.05 // 5% OFF
-	case "Silver":
-		return 0.03 // 3% OFF
+// 計画した引当を確定する
+// 書き込みロックの中で、計画に使ったすべての倉庫の在庫が計画時（observed）から変わっていないことを確認してから減らす
+// 1つでも変わっていれば何も減らさずに false を返す（安全在庫の判定も計画時の合計に基づくため、引き当てない倉庫も比較する）
+func commitStockAllocation(productID int, allocations map[int]int, observed map[int]int) bool {
+	stockMux.Lock()
+	defer stockMux.Unlock()
+
+	for warehouseID, quantity := range observed {
+		stock := stocks[fmt.Sprintf("%d-%d", productID, warehouseID)]
+		if stock == nil || stock.Quantity != quantity {
+			return false
+		}
+	}
+	for warehouseID, quantity := range allocations {
+		stocks[fmt.Sprintf("%d-%d", productID, warehouseID)].Quantity -= quantity
+	}
+	return true
+}
+
+// 引当済みの在庫を倉庫に戻す（在庫行が削除されていた場合は作り直す）
+// 引き当て後の入荷などで元の倉庫の容量を超える分は、容量に空きのある他の倉庫（ID順）に戻す
+// どの倉庫にも空きがない場合は元の倉庫に戻してログに残す（キャンセル・返金を止めない）
+func releaseStock(allocations map[int]map[int]int) {
+	stockMux.Lock()
+	defer stockMux.Unlock()
+	warehouseMux.RLock()
+	defer warehouseMux.RUnlock()
+
+	warehouseIDs := make([]int, 0, len(warehouses))
+	for id := range warehouses {
+		warehouseIDs = append(warehouseIDs, id)
+	}
+	sort.Ints(warehouseIDs)
+
+	for productID, byWarehouse := range allocations {
+		for warehouseID, quantity := range byWarehouse {
+			remaining := quantity - addStockWithinCapacity(productID, warehouseID, quantity)
+			for _, otherID := range warehouseIDs {
+				if remaining <= 0 {
+					break
+				}
+				if otherID != warehouseID {
+					remaining -= addStockWithinCapacity(productID, otherID, remaining)
+				}
+			}
+			if remaining > 0 {
+				log.Printf("Returned %d units of product %d to warehouse %d beyond its capacity; no warehouse has room", remaining, productID, warehouseID)
+				addStock(productID, warehouseID, remaining)
+			}
+		}
+	}
+}
+
+// 倉庫の容量の範囲で在庫を戻し、戻した数を返す（削除済みの倉庫には戻さない）
+// 呼び出し側で stockMux と warehouseMux（読み取り）をロックしていること
+func addStockWithinCapacity(productID, warehouseID, quantity int) int {
+	warehouse := warehouses[warehouseID]
+	if warehouse == nil {
+		return 0
+	}
+	if warehouse.Capacity > 0 {
+		if room := warehouse.Capacity - warehouseStockTotal(warehouseID); room < quantity {
+			quantity = room
+		}
+	}
+	if quantity <= 0 {
+		return 0
+	}
+	addStock(productID, warehouseID, quantity)
+	return quantity
+}
+
+// 在庫行に数量を加える（在庫行がなければ作る）
+// 呼び出し側で stockMux をロックしていること
+func addStock(productID, warehouseID, quantity int) {
+	key := fmt.Sprintf("%d-%d", productID, warehouseID)
+	stock := stocks[key]
+	if stock == nil {
+		stock = &Stock{ProductID: productID, WarehouseID: warehouseID}
+		stocks[key] = stock
+	}
+	stock.Quantity += quantity
+}
+
+// 注文ステータスを変更し、履歴に記録する
+// 保存済みの注文を変更する場合は呼び出し側で orderMux をロックしていること
+func setOrderStatus(order *Order, status string, changedBy int) {
+	order.Status = status
+	order.StatusHistory = append(order.StatusHistory, OrderStatusChange{
+		Status:    status,
+		ChangedAt: time.Now(),
+		ChangedBy: changedBy,
+	})
+}
+
+// 注文の全明細の在庫を引き当てる
+// 一部の明細で引当に失敗した場合は、それまでに引き当てた在庫を戻して false を返す
+func allocateOrderStock(cfg Config, items []OrderItem, dest *GeoPoint) (map[int]map[int]int, bool) {
+	allocations := make(map[int]map[int]int) // productID -> warehouseID -> quantity
+	for _, item := range items {
+		allocated, byWarehouse := allocateStock(cfg, item.ProductID, item.Quantity, dest)
+		if !allocated {
+			releaseStock(allocations)
+			return nil, false
+		}
+		// 同じ商品が複数明細にある場合は倉庫ごとに合算する
+		if allocations[item.ProductID] == nil {
+			allocations[item.ProductID] = make(map[int]int)
+		}
+		for warehouseID, quantity := range byWarehouse {
+			allocations[item.ProductID][warehouseID] += quantity
+		}
+	}
+	return allocations, true
+}
+
+// 商品小計がしきい値以上の購入金額特典のプレゼント明細（在庫は確認しない）
+// 複数の特典が同じ商品を指す場合は1個にまとめ、削除済み・販売開始前の商品は対象外
+func selectGiftItems(subtotal int) []OrderItem {
+	giftRuleMux.RLock()
+	var productIDs []int
+	seen := make(map[int]bool)
+	for _, rule := range giftRules {
+		if subtotal >= rule.Threshold && !seen[rule.GiftProductID] {
+			seen[rule.GiftProductID] = true
+			productIDs = append(productIDs, rule.GiftProductID)
+		}
+	}
+	giftRuleMux.RUnlock()
+	sort.Ints(productIDs)
+
+	var gifts []OrderItem
+	productMux.RLock()
+	for _, productID := range productIDs {
+		product := products[productID]
+		if product == nil || isPreOrder(product) {
+			continue
+		}
+		gifts = append(gifts, OrderItem{ProductID: productID, Quantity: 1, UnitPrice: 0, ProductName: product.Name, IsGift: true})
+	}
+	productMux.RUnlock()
+	return gifts
+}
+
+// プレゼント明細の在庫を引き当てて注文に追加する（在庫切れのプレゼントは追加しない）
+// 呼び出し側で注文を保存する前に呼ぶこと
+func addGiftItems(cfg Config, order *Order, gifts []OrderItem) {
+	for _, gift := range gifts {
+		allocated, byWarehouse := allocateStock(cfg, gift.ProductID, gift.Quantity, order.Destination)
+		if !allocated {
+			continue
+		}
+		if order.Allocations[gift.ProductID] == nil {
+			order.Allocations[gift.ProductID] = make(map[int]int)
+		}
+		for warehouseID, quantity := range byWarehouse {
+			order.Allocations[gift.ProductID][warehouseID] += quantity
+		}
+		order.Items = append(order.Items, gift)
+	}
+}
+
+// 在庫監査イベントを記録する（呼び出し側で stockMux をロックしていること）
+func recordStockAuditEvent(productID, warehouseID, delta int, reason string, balance int, userID int) *StockAuditEvent {
+	stockAuditMux.Lock()
+	defer stockAuditMux.Unlock()
+
+	event := &StockAuditEvent{
+		ID:          nextStockAuditID,
+		ProductID:   productID,
+		WarehouseID: warehouseID,
+		Delta:       delta,
+		Reason:      reason,
+		Balance:     balance,
+		UserID:      userID,
+		CreatedAt:   time.Now(),
+	}
+	stockAuditEvents[event.ID] = event
+	nextStockAuditID++
+	return event
+}
+
+// クーポン割引計算ヘルパー関数
+func calculateCouponDiscount(cfg Config, coupon *Coupon, baseAmount int) int {
+	if coupon == nil {
+		return 0
+	}
+
+	var discount int
+	switch coupon.Type {
+	case "fixed":
+		discount = coupon.Amount
+	case "percentage", "shipping":
+		// shipping の場合、baseAmount には送料が渡される
+		discount = percentOfAmount(cfg, baseAmount, coupon.Amount)
 	default:
-		return 0.0
+		return 0
+	}
+
+	// 割引額が元の金額を超えないようにする
+	if discount > baseAmount {
+		discount = baseAmount
 	}
+
+	return discount
 }
 
-// ユーザーの累計購入金額を更新してランクを再計算
-func updateUserPurchaseAmountAndRank(userID int, amount int) {
-	userMux.Lock()
-	defer userMux.Unlock()
+// クーポンが注文に適用できるか判定する
+// 適用できない場合はエラーコードとメッセージを返す（適用できる場合は空文字）
+func checkCouponApplicable(coupon *Coupon, subtotal int, categories map[string]bool, now time.Time) (code string, message string) {
+	if coupon.ValidFrom != nil && now.Before(*coupon.ValidFrom) {
+		return "coupon_not_yet_valid", "Coupon is not yet valid"
+	}
+	if coupon.ExpiresAt != nil && !now.Before(*coupon.ExpiresAt) {
+		return "coupon_expired", "Coupon has expired"
+	}
+	if coupon.MinOrderAmount > 0 && subtotal < coupon.MinOrderAmount {
+		return "coupon_min_order_not_met",
+			fmt.Sprintf("Order subtotal %d does not meet the coupon minimum %d", subtotal, coupon.MinOrderAmount)
+	}
+	if coupon.Category != "" && !categories[coupon.Category] {
+		return "coupon_category_mismatch",
+			fmt.Sprintf("Coupon applies only to orders containing %s products", coupon.Category)
+	}
+	return "", ""
+}
 
-	if user, exists := users[userID]; exists {
-		user.TotalSpentAmount += amount
-		newRank := calculateMemberRank(user.TotalSpentAmount)
-		user.MemberRank = newRank
+// 金額に対する割合（%）の計算
+// 補助単位のない通貨（JPY）は従来どおり切り捨て、補助単位のある通貨は最小単位に四捨五入する
+// 設定は呼び出し側の価格計算と同じもの（cfg）を使う
+func percentOfAmount(cfg Config, amount, percent int) int {
+	if cfg.CurrencyMinorUnits > 0 {
+		return (amount*percent + 50) / 100
 	}
+	return amount * percent / 100
 }
 
-// ポイントの付与
-func addPoints(userID int, orderID int, points int) {
-	userMux.Lock()
-	defer userMux.Unlock()
+// 金額に対する率（0.05 = 5%）の計算（端数処理は percentOfAmount と同じ）
+func rateOfAmount(cfg Config, amount int, rate float64) int {
+	value := float64(amount) * rate
+	if cfg.CurrencyMinorUnits > 0 {
+		return int(math.Round(value))
+	}
+	return int(value)
+}
 
-	if user, exists := users[userID]; exists {
-		user.CurrentPoints += points
+// クーポンの利用回数（完了した注文で数える）
+func couponUsageCount(code string) int {
+	orderMux.RLock()
+	defer orderMux.RUnlock()
 
-		// ポイント履歴を記録
-		pointHistoryMux.Lock()
-		history := &PointHistory{
-			ID:        nextPointHistoryID,
-			UserID:    userID,
-			OrderID:   orderID,
-			Type:      "earned",
-			Amount:    points,
-			Balance:   user.CurrentPoints,
-			CreatedAt: time.Now(),
+	count := 0
+	for _, order := range orders {
+		if isCompletedSale(order) && order.AppliedCoupon == code {
+			count++
 		}
-		pointHistories[nextPointHistoryID] = history
-		nextPointHistoryID++
-		pointHistoryMux.Unlock()
 	}
+	return count
 }
 
-// ポイントの使用
-func usePoints(userID int, orderID int, points int) bool {
-	userMux.Lock()
-	defer userMux.Unlock()
+// ユーザーに完了した注文があるか
+func hasCompletedOrder(userID int) bool {
+	orderMux.RLock()
+	defer orderMux.RUnlock()
 
-	if user, exists := users[userID]; exists {
-		if user.CurrentPoints >= points {
-			user.CurrentPoints -= points
+	for _, order := range orders {
+		if order.UserID == userID && isCompletedSale(order) {
+			return true
+		}
+	}
+	return false
+}
 
-			// ポイント履歴を記録
-			pointHistoryMux.Lock()
-			history := &PointHistory{
-				ID:        nextPointHistoryID,
-				UserID:    userID,
-				OrderID:   orderID,
-				Type:      "used",
-				Amount:    points,
-				Balance:   user.CurrentPoints,
-				CreatedAt: time.Now(),
+// クーポンの利用回数上限と初回購入限定の判定（user が nil の場合は初回購入限定クーポンを利用不可とする）
+func checkCouponEligibility(coupon *Coupon, user *User) (code string, message string) {
+	if coupon.UsageLimit > 0 && couponUsageCount(coupon.Code) >= coupon.UsageLimit {
+		return "coupon_usage_limit_reached", "Coupon usage limit has been reached"
+	}
+	if coupon.FirstPurchaseOnly && (user == nil || hasCompletedOrder(user.ID)) {
+		return "coupon_first_purchase_only", "Coupon is only available for a first purchase"
+	}
+	return "", ""
+}
+
+// 利用可能なクーポンのうち支払額が最も安くなるものを選ぶ（該当なしは nil）
+// クーポンなしの支払額より安くならないもの（割引が上限で打ち消されるなど）は選ばない
+// 支払額が同じ場合はコード順で先のものを選ぶ
+func selectBestCoupon(cfg Config, subtotal, saleDiscount int, categories map[string]bool, rank string, usePoints int, user *User) *Coupon {
+	couponMux.RLock()
+	candidates := make([]*Coupon, 0, len(coupons))
+	for _, coupon := range coupons {
+		candidates = append(candidates, coupon)
+	}
+	couponMux.RUnlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Code < candidates[j].Code
+	})
+
+	now := time.Now()
+	var best *Coupon
+	bestTotal := calculateOrderTotalsWithSale(cfg, subtotal, saleDiscount, rank, nil, usePoints).TotalPrice
+	for _, coupon := range candidates {
+		if code, _ := checkCouponApplicable(coupon, subtotal, categories, now); code != "" {
+			continue
+		}
+		if code, _ := checkCouponEligibility(coupon, user); code != "" {
+			continue
+		}
+		total := calculateOrderTotalsWithSale(cfg, subtotal, saleDiscount, rank, coupon, usePoints).TotalPrice
+		if total < bestTotal {
+			best = coupon
+			bestTotal = total
+		}
+	}
+	return best
+}
+
+// 支払い金額の算出アルゴリズム（MT-8仕様書の順序に従う）
+// 注文作成と見積もり系のAPIで共通して利用する
+// 設定（cfg）は呼び出し側で currentConfig() から1回だけ取得し、1つの注文の計算中は同じものを使う
+// （計算の途中で PATCH /admin/config が反映されて、税率とポイント付与率などが別々の設定にならないように）
+func calculateOrderTotals(cfg Config, subtotal int, rank string, coupon *Coupon, usePoints int) OrderTotals {
+	return calculateOrderTotalsWithSale(cfg, subtotal, 0, rank, coupon, usePoints)
+}
+
+// カテゴリセールの割引額（saleDiscount、subtotal には反映済み）を割引合計の上限判定に含めて計算する
+// 割引合計が MAX_DISCOUNT_PERCENT を超える場合は、クーポン割引、次にランク割引の順に上限まで減額する
+// （カテゴリセール単独で上限を超える場合はセール価格のまま）
+func calculateOrderTotalsWithSale(cfg Config, subtotal, saleDiscount int, rank string, coupon *Coupon, usePoints int) OrderTotals {
+	// 割引合計の上限（セール前の商品小計に対する割合）
+	maxDiscount := -1
+	if cfg.MaxDiscountPercent > 0 {
+		maxDiscount = percentOfAmount(cfg, subtotal+saleDiscount, cfg.MaxDiscountPercent)
+	}
+	discountCapped := false
+	clampDiscount := func(discount, alreadyDiscounted int) int {
+		if maxDiscount < 0 {
+			return discount
+		}
+		allowed := maxDiscount - alreadyDiscounted
+		if allowed < 0 {
+			allowed = 0
+		}
+		if discount > allowed {
+			discountCapped = true
+			return allowed
+		}
+		return discount
+	}
+
+	// 1. 商品小計の算出（会員ランク割引を適用）
+	rankDiscountRate := getRankDiscountRate(rank)
+	rankDiscountAmount := clampDiscount(rateOfAmount(cfg, subtotal, rankDiscountRate), saleDiscount)
+	discountedSubtotal := subtotal - rankDiscountAmount
+
+	// 2. 消費税の加算（ランク割引後の小計に対し TAX_RATE_PERCENT）
+	tax := percentOfAmount(cfg, discountedSubtotal, cfg.TaxRatePercent)
+	subtotalWithTax := discountedSubtotal + tax
+
+	// 3. 送料の確定
+	shippingFee := 0
+	if !hasFreeShippingRank(rank) { // ゴールド会員は常に送料無料
+		if subtotalWithTax < cfg.FreeShippingThreshold {
+			shippingFee = cfg.StandardShippingFee
+		}
+	}
+
+	// 4. クーポン割引の適用（商品代金＋消費税に対して、送料は対象外）
+	// 送料割引クーポンのみ送料に対して適用する（ランク特典で送料0円の場合は割引なし）
+	var couponDiscountAmount int
+	if coupon != nil && coupon.Type == "shipping" {
+		couponDiscountAmount = calculateCouponDiscount(cfg, coupon, shippingFee)
+	} else {
+		couponDiscountAmount = calculateCouponDiscount(cfg, coupon, subtotalWithTax)
+	}
+	couponDiscountAmount = clampDiscount(couponDiscountAmount, saleDiscount+rankDiscountAmount)
+	afterCouponAmount := subtotalWithTax - couponDiscountAmount
+
+	// 5. ポイント利用（最後に差し引く、1ポイントあたり POINTS_REDEMPTION_RATE 円、支払額を超える分は利用しない）
+	// 支払額を超える場合は支払額を賄える最小のポイント数だけ利用し、値引き額は支払額までとする
+	payable := afterCouponAmount + shippingFee
+	usedPoints := usePoints
+	pointsDiscount := rateOfAmount(cfg, usedPoints, cfg.PointsRedemptionRate)
+	if pointsDiscount > payable {
+		usedPoints = int(math.Ceil(float64(payable) / cfg.PointsRedemptionRate))
+		pointsDiscount = payable
+	}
+	afterPointsAmount := payable - pointsDiscount
+
+	// 6. ポイント付与の計算（最終支払額の POINTS_RATE_PERCENT、端数は POINTS_ROUNDING に従う）
+	earnedPoints := calculateEarnedPoints(cfg, afterPointsAmount)
+	if isHeavilyDiscounted(cfg, subtotal, rankDiscountAmount+couponDiscountAmount) {
+		earnedPoints = 0
+	}
+
+	return OrderTotals{
+		Subtotal:       subtotal,
+		RankDiscount:   rankDiscountAmount,
+		Tax:            tax,
+		ShippingFee:    shippingFee,
+		CouponDiscount: couponDiscountAmount,
+		UsedPoints:     usedPoints,
+		PointsDiscount: pointsDiscount,
+		TotalPrice:     afterPointsAmount,
+		EarnedPoints:   earnedPoints,
+
+		SaleDiscount:   saleDiscount,
+		DiscountCapped: discountCapped,
+	}
+}
+
+// 支払額に対する付与ポイント（端数処理は設定に従い、未知の値は切り捨て）
+func calculateEarnedPoints(cfg Config, amount int) int {
+	base := amount * cfg.PointsRatePercent
+	switch cfg.PointsRounding {
+	case pointsRoundingCeil:
+		return (base + 99) / 100
+	case pointsRoundingRound:
+		return (base + 50) / 100
+	default:
+		return base / 100
+	}
+}
+
+// 注文時点で適用される価格ルールを記録する（支払額の計算に使った設定 cfg をそのまま記録する）
+func buildAppliedBenefits(cfg Config, rank string, coupon *Coupon) *AppliedBenefits {
+	benefits := &AppliedBenefits{
+		Rank:                   rank,
+		RankDiscountRate:       getRankDiscountRate(rank),
+		TaxRatePercent:         cfg.TaxRatePercent,
+		PointsRatePercent:      cfg.PointsRatePercent,
+		PointsExclusionPercent: cfg.PointsExclusionDiscountPercent,
+		PointsRounding:         cfg.PointsRounding,
+		MaxDiscountPercent:     cfg.MaxDiscountPercent,
+		FreeShippingByRank:     hasFreeShippingRank(rank),
+		PointsRedemptionRate:   cfg.PointsRedemptionRate,
+		FreeShippingThreshold:  cfg.FreeShippingThreshold,
+		StandardShippingFee:    cfg.StandardShippingFee,
+	}
+	if coupon != nil {
+		// 後からクーポン条件が変更されても影響を受けないようコピーを保存
+		couponCopy := *coupon
+		benefits.Coupon = &couponCopy
+	}
+	return benefits
+}
+
+// 割引額が小計に対して設定された割合を超えているか（ポイント付与対象外の判定）
+func isHeavilyDiscounted(cfg Config, subtotal, totalDiscount int) bool {
+	threshold := cfg.PointsExclusionDiscountPercent
+	if threshold <= 0 || subtotal <= 0 {
+		return false
+	}
+	return totalDiscount*100 > subtotal*threshold
+}
+
+// 倉庫別在庫数がしきい値以下の商品×倉庫を在庫の少ない順に返す
+func findLowStockLocations(threshold int) []LowStockLocation {
+	locations := []LowStockLocation{}
+
+	// ロック順序は他の処理と同じく product → stock → warehouse
+	productMux.RLock()
+	stockMux.RLock()
+	warehouseMux.RLock()
+	for _, stock := range stocks {
+		if stock.Quantity > threshold {
+			continue
+		}
+		product, productExists := products[stock.ProductID]
+		warehouse, warehouseExists := warehouses[stock.WarehouseID]
+		if !productExists || !warehouseExists {
+			continue
+		}
+		locations = append(locations, LowStockLocation{
+			ProductID:     product.ID,
+			ProductName:   product.Name,
+			WarehouseID:   warehouse.ID,
+			WarehouseName: warehouse.Name,
+			Quantity:      stock.Quantity,
+		})
+	}
+	warehouseMux.RUnlock()
+	stockMux.RUnlock()
+	productMux.RUnlock()
+
+	sort.Slice(locations, func(i, j int) bool {
+		a, b := locations[i], locations[j]
+		if a.Quantity != b.Quantity {
+			return a.Quantity < b.Quantity
+		}
+		if a.ProductID != b.ProductID {
+			return a.ProductID < b.ProductID
+		}
+		return a.WarehouseID < b.WarehouseID
+	})
+	return locations
+}
+
+// 販売分析レポート集計関数
+func generateSalesReport() *SalesReportResponse {
+	report := &SalesReportResponse{}
+
+	// 1. 販売サマリーの集計
+	orderMux.RLock()
+	totalRevenue := 0
+	completedOrders := 0
+	couponUsedOrders := 0
+	totalOrdersForCouponRate := 0
+	productQuantities := make(map[int]int) // productID -> total quantity
+	productNames := make(map[int]string)   // productID -> 注文時点の商品名
+
+	for _, order := range orders {
+		// クーポン利用率の計算用（全注文をカウント）
+		if isCompletedSale(order) || order.Status == "payment_failed" {
+			totalOrdersForCouponRate++
+			if order.AppliedCoupon != "" {
+				couponUsedOrders++
 			}
-			pointHistories[nextPointHistoryID] = history
-			nextPointHistoryID++
-			pointHistoryMux.Unlock()
-			return true
 		}
+
+		// 売上とランキングは完了した注文のみ
+		if isCompletedSale(order) {
+			totalRevenue += order.TotalPrice
+			completedOrders++
+
+			// 商品ごとの販売数量を集計（購入金額特典のプレゼントは販売数量に含めない）
+			for _, item := range order.Items {
+				if item.IsGift {
+					continue
+				}
+				productQuantities[item.ProductID] += item.Quantity
+				if item.ProductName != "" && productNames[item.ProductID] == "" {
+					productNames[item.ProductID] = item.ProductName
+				}
+			}
+		}
+	}
+	orderMux.RUnlock()
+
+	report.SalesSummary = SalesSummary{
+		TotalRevenue: totalRevenue,
+		TotalOrders:  completedOrders,
+	}
+
+	// 2. 人気商品ランキング（トップ3）
+	type productQty struct {
+		ID       int
+		Name     string
+		Quantity int
+	}
+	var rankings []productQty
+
+	productMux.RLock()
+	for productID, qty := range productQuantities {
+		// 注文時点の商品名を優先し、記録がない場合のみ現在の商品名を使う
+		name := productNames[productID]
+		if name == "" {
+			product, exists := products[productID]
+			if !exists {
+				continue
+			}
+			name = product.Name
+		}
+		rankings = append(rankings, productQty{
+			ID:       productID,
+			Name:     name,
+			Quantity: qty,
+		})
+	}
+	productMux.RUnlock()
+
+	// 販売数量でソート（降順）
+	for i := 0; i < len(rankings); i++ {
+		for j := i + 1; j < len(rankings); j++ {
+			if rankings[j].Quantity > rankings[i].Quantity {
+				rankings[i], rankings[j] = rankings[j], rankings[i]
+			}
+		}
+	}
+
+	// トップ3を取得
+	topProducts := []ProductRanking{}
+	for i := 0; i < len(rankings) && i < 3; i++ {
+		topProducts = append(topProducts, ProductRanking{
+			ProductName:   rankings[i].Name,
+			TotalQuantity: rankings[i].Quantity,
+		})
+	}
+	report.TopProducts = topProducts
+
+	// 3. 倉庫別在庫サマリー
+	warehouseStocks := make(map[int]int) // warehouseID -> total stock
+	productStocks := make(map[int]int)   // productID -> total stock
+	stockMux.RLock()
+	for _, stock := range stocks {
+		if stock.Quantity > 0 {
+			warehouseStocks[stock.WarehouseID] += stock.Quantity
+			productStocks[stock.ProductID] += stock.Quantity
+		}
+	}
+	stockMux.RUnlock()
+
+	warehouseInventory := []WarehouseInventoryStat{}
+	warehouseMux.RLock()
+	for warehouseID, totalStock := range warehouseStocks {
+		if warehouse, exists := warehouses[warehouseID]; exists {
+			warehouseInventory = append(warehouseInventory, WarehouseInventoryStat{
+				WarehouseName: warehouse.Name,
+				TotalStock:    totalStock,
+			})
+		}
+	}
+	warehouseMux.RUnlock()
+
+	// 倉庫名でソート（安定した出力のため）
+	for i := 0; i < len(warehouseInventory); i++ {
+		for j := i + 1; j < len(warehouseInventory); j++ {
+			if warehouseInventory[j].WarehouseName < warehouseInventory[i].WarehouseName {
+				warehouseInventory[i], warehouseInventory[j] = warehouseInventory[j], warehouseInventory[i]
+			}
+		}
+	}
+	report.WarehouseInventory = warehouseInventory
+
+	// 4. カテゴリ別在庫サマリー
+	categoryStocks := make(map[string]int) // category -> total stock
+	productMux.RLock()
+	for productID, totalStock := range productStocks {
+		if product, exists := products[productID]; exists {
+			categoryStocks[product.Category] += totalStock
+		}
+	}
+	productMux.RUnlock()
+
+	categoryInventory := []CategoryInventoryStat{}
+	for category, totalStock := range categoryStocks {
+		categoryInventory = append(categoryInventory, CategoryInventoryStat{
+			Category:   category,
+			TotalStock: totalStock,
+		})
+	}
+
+	// カテゴリ名でソート（安定した出力のため）
+	sort.Slice(categoryInventory, func(i, j int) bool {
+		return categoryInventory[i].Category < categoryInventory[j].Category
+	})
+	report.CategoryInventory = categoryInventory
+
+	// 5. 在庫が少ない商品×倉庫の一覧
+	report.LowStockLocations = findLowStockLocations(currentConfig().LowStockThreshold)
+
+	// 6. プロモーション効果分析
+	couponUsageRate := 0.0
+	if totalOrdersForCouponRate > 0 {
+		couponUsageRate = float64(couponUsedOrders) / float64(totalOrdersForCouponRate) * 100
+	}
+	report.PromotionAnalysis = PromotionAnalysis{
+		CouponUsageRate: couponUsageRate,
+	}
+
+	return report
+}
+
+// お気に入り関連のヘルパー関数
+func isProductInWishlist(userID int, productID int) bool {
+	key := fmt.Sprintf("%d-%d", userID, productID)
+	wishlistMux.RLock()
+	defer wishlistMux.RUnlock()
+	_, exists := wishlists[key]
+	return exists
+}
+
+var (
+	errWishlistDuplicate       = errors.New("product already in wishlist")
+	errWishlistFull            = errors.New("wishlist full")
+	errWishlistProductNotFound = errors.New("product not found")
+)
+
+// お気に入りに追加する
+// 商品の存在確認と登録を productMux を保持したまま行い、削除済み商品の登録を防ぐ
+// ロック順序は product → wishlist
+func addToWishlist(userID int, productID int) error {
+	key := fmt.Sprintf("%d-%d", userID, productID)
+	productMux.RLock()
+	defer productMux.RUnlock()
+	if products[productID] == nil {
+		return errWishlistProductNotFound
+	}
+
+	wishlistMux.Lock()
+	defer wishlistMux.Unlock()
+
+	if _, exists := wishlists[key]; exists {
+		return errWishlistDuplicate // 既に登録済み
+	}
+
+	// 登録数の上限チェック
+	count := 0
+	for _, wishlist := range wishlists {
+		if wishlist != nil && wishlist.UserID == userID {
+			count++
+		}
+	}
+	if count >= currentConfig().MaxWishlistSize {
+		return errWishlistFull
+	}
+
+	wishlists[key] = &Wishlist{
+		UserID:    userID,
+		ProductID: productID,
+	}
+	return nil
+}
+
+func removeFromWishlist(userID int, productID int) bool {
+	key := fmt.Sprintf("%d-%d", userID, productID)
+	wishlistMux.Lock()
+	defer wishlistMux.Unlock()
+
+	if _, exists := wishlists[key]; !exists {
+		return false // 存在しない
+	}
+
+	delete(wishlists, key)
+	return true
+}
+
+// 商品を削除し、その商品のお気に入り登録とカートの明細も取り除く
+func deleteProduct(productID int) {
+	productMux.Lock()
+	defer productMux.Unlock()
+
+	if product := products[productID]; product != nil && product.ExternalID != "" {
+		delete(productsByExternalID, product.ExternalID)
+	}
+	delete(products, productID)
+
+	wishlistMux.Lock()
+	for key, wishlist := range wishlists {
+		if wishlist != nil && wishlist.ProductID == productID {
+			delete(wishlists, key)
+		}
+	}
+	wishlistMux.Unlock()
+
+	cartMux.Lock()
+	for _, cart := range carts {
+		items := cart.Items[:0]
+		for _, item := range cart.Items {
+			if item.ProductID != productID {
+				items = append(items, item)
+			}
+		}
+		cart.Items = items
+	}
+	cartMux.Unlock()
+}
+
+// 閲覧履歴として保持する商品数（ユーザーごと、古いものから捨てる）
+const maxRecentViews = 20
+
+// 認証済みユーザーの商品詳細の閲覧を記録する（同じ商品は最新の位置に移す）
+func recordProductView(userID, productID int) {
+	recentViewMux.Lock()
+	defer recentViewMux.Unlock()
+
+	views := recentViews[userID]
+	for i, id := range views {
+		if id == productID {
+			views = append(views[:i], views[i+1:]...)
+			break
+		}
+	}
+	views = append(views, productID)
+	if len(views) > maxRecentViews {
+		views = views[len(views)-maxRecentViews:]
+	}
+	recentViews[userID] = views
+}
+
+// カテゴリごとの件数を最大件数で割った 0〜1 の親和度
+func normalizeCategoryCounts(counts map[string]int) map[string]float64 {
+	maxCount := 0
+	for _, n := range counts {
+		if n > maxCount {
+			maxCount = n
+		}
+	}
+	affinity := make(map[string]float64, len(counts))
+	for category, n := range counts {
+		affinity[category] = float64(n) / float64(maxCount)
+	}
+	return affinity
+}
+
+// おすすめ商品の選定
+// お気に入り・過去の購入・最近の閲覧のカテゴリ親和度（それぞれ 0〜1）と人気度（販売数量を最大値で割った 0〜1）を
+// 設定の重みで足し合わせたスコアの高い順に返す。いずれかのカテゴリ親和度がある商品のみを候補とし、
+// お気に入り登録済み・購入済み・在庫切れの商品は除く
+func getRecommendations(userID int) []RecommendedProduct {
+	cfg := currentConfig()
+
+	// お気に入り登録済みの商品
+	wishlistMux.RLock()
+	userFavorites := make(map[int]bool)
+	for _, wishlist := range wishlists {
+		if wishlist != nil && wishlist.UserID == userID {
+			userFavorites[wishlist.ProductID] = true
+		}
+	}
+	wishlistMux.RUnlock()
+
+	// 購入済みの商品（完了注文の明細、件数はカテゴリ親和度に使う）
+	owned := make(map[int]int)
+	orderMux.RLock()
+	for _, order := range orders {
+		if order.UserID != userID || !isCompletedSale(order) {
+			continue
+		}
+		for _, item := range order.Items {
+			owned[item.ProductID]++
+		}
+	}
+	orderMux.RUnlock()
+
+	recentViewMux.Lock()
+	viewed := append([]int(nil), recentViews[userID]...)
+	recentViewMux.Unlock()
+
+	popularity := completedOrderQuantities()
+	maxPopularity := 0
+	for _, quantity := range popularity {
+		if quantity > maxPopularity {
+			maxPopularity = quantity
+		}
+	}
+
+	productMux.RLock()
+	defer productMux.RUnlock()
+
+	wishlistCounts := make(map[string]int)
+	for productID := range userFavorites {
+		if product := products[productID]; product != nil {
+			wishlistCounts[product.Category]++
+		}
+	}
+	purchaseCounts := make(map[string]int)
+	for productID, n := range owned {
+		if product := products[productID]; product != nil {
+			purchaseCounts[product.Category] += n
+		}
+	}
+	viewCounts := make(map[string]int)
+	for _, productID := range viewed {
+		if product := products[productID]; product != nil {
+			viewCounts[product.Category]++
+		}
+	}
+	wishlistAffinity := normalizeCategoryCounts(wishlistCounts)
+	purchaseAffinity := normalizeCategoryCounts(purchaseCounts)
+	viewAffinity := normalizeCategoryCounts(viewCounts)
+
+	recommendations := []RecommendedProduct{}
+	for _, product := range products {
+		if userFavorites[product.ID] || owned[product.ID] > 0 {
+			continue
+		}
+		wish, purchase, view := wishlistAffinity[product.Category], purchaseAffinity[product.Category], viewAffinity[product.Category]
+		if wish == 0 && purchase == 0 && view == 0 {
+			continue
+		}
+		// ロック順序は product → stock
+		totalStock, _ := getProductStock(product.ID)
+		if sellableStock(cfg, product, totalStock) <= 0 {
+			continue
+		}
+
+		score := float64(cfg.RecommendWeightWishlist)*wish +
+			float64(cfg.RecommendWeightPurchase)*purchase +
+			float64(cfg.RecommendWeightView)*view
+		if maxPopularity > 0 {
+			score += float64(cfg.RecommendWeightPopularity) * float64(popularity[product.ID]) / float64(maxPopularity)
+		}
+		recommendations = append(recommendations, RecommendedProduct{
+			ID:       product.ID,
+			Name:     product.Name,
+			Price:    product.Price,
+			Category: product.Category,
+			Score:    math.Round(score*1000) / 1000,
+		})
+	}
+
+	// スコアの高い順（同点なら商品IDの昇順）
+	sort.Slice(recommendations, func(i, j int) bool {
+		if recommendations[i].Score != recommendations[j].Score {
+			return recommendations[i].Score > recommendations[j].Score
+		}
+		return recommendations[i].ID < recommendations[j].ID
+	})
+	if cfg.RecommendationLimit > 0 && len(recommendations) > cfg.RecommendationLimit {
+		recommendations = recommendations[:cfg.RecommendationLimit]
+	}
+	return recommendations
+}
+
+// 会員ランク判定ヘルパー関数
+func calculateMemberRank(totalSpent int) string {
+	return rankTierFor(totalSpent).Name
+}
+
+// 会員ランクの区分（累計購入金額の下限の昇順）
+type RankTier struct {
+	Name     string `json:"name"`
+	MinSpent int    `json:"min_spent"`
+}
+
+var rankTiers = []RankTier{
+	{Name: "Normal", MinSpent: 0},
+	{Name: "Silver", MinSpent: 50000},
+	{Name: "Gold", MinSpent: 100000},
+}
+
+// 累計購入金額に該当するランク区分
+func rankTierFor(totalSpent int) RankTier {
+	tier := rankTiers[0]
+	for _, t := range rankTiers {
+		if totalSpent >= t.MinSpent {
+			tier = t
+		}
+	}
+	return tier
+}
+
+// 次のランク区分（最上位の場合は false）
+func nextRankTier(totalSpent int) (RankTier, bool) {
+	for _, t := range rankTiers {
+		if totalSpent < t.MinSpent {
+			return t, true
+		}
+	}
+	return RankTier{}, false
+}
+
+// ランクによる割引率を取得
+func getRankDiscountRate(rank string) float64 {
+	switch rank {
+	case "Gold":
+		return 0.05 // 5% OFF
+	case "Silver":
+		return 0.03 // 3% OFF
+	default:
+		return 0.0
+	}
+}
+
+// ランクにより常に送料無料となるか
+func hasFreeShippingRank(rank string) bool {
+	return rank == "Gold"
+}
+
+// ユーザーの累計購入金額を更新してランクを再計算
+func updateUserPurchaseAmountAndRank(userID int, amount int) {
+	userMux.Lock()
+	defer userMux.Unlock()
+
+	if user, exists := users[userID]; exists {
+		user.TotalSpentAmount += amount
+		newRank := calculateMemberRank(user.TotalSpentAmount)
+		user.MemberRank = newRank
+	}
+}
+
+// 決済・在庫引当が完了した注文のポイント付与と、累計購入金額・ランクの更新
+func applyOrderCompletion(order *Order) {
+	if order.EarnedPoints > 0 {
+		addPoints(order.UserID, order.ID, order.EarnedPoints)
+	}
+	updateUserPurchaseAmountAndRank(order.UserID, order.TotalPrice)
+}
+
+// ポイントの付与
+func addPoints(userID int, orderID int, points int) {
+	userMux.Lock()
+	defer userMux.Unlock()
+
+	if user, exists := users[userID]; exists {
+		user.CurrentPoints += points
+
+		// ポイント履歴を記録
+		pointHistoryMux.Lock()
+		history := &PointHistory{
+			ID:        nextPointHistoryID,
+			UserID:    userID,
+			OrderID:   orderID,
+			Type:      "earned",
+			Amount:    points,
+			Balance:   user.CurrentPoints,
+			CreatedAt: time.Now(),
+		}
+		pointHistories[nextPointHistoryID] = history
+		nextPointHistoryID++
+		pointHistoryMux.Unlock()
+	}
+}
+
+// ポイントの使用
+func usePoints(userID int, orderID int, points int) bool {
+	userMux.Lock()
+	defer userMux.Unlock()
+
+	if user, exists := users[userID]; exists {
+		if user.CurrentPoints >= points {
+			user.CurrentPoints -= points
+
+			// ポイント履歴を記録
+			pointHistoryMux.Lock()
+			history := &PointHistory{
+				ID:        nextPointHistoryID,
+				UserID:    userID,
+				OrderID:   orderID,
+				Type:      "used",
+				Amount:    points,
+				Balance:   user.CurrentPoints,
+				CreatedAt: time.Now(),
+			}
+			pointHistories[nextPointHistoryID] = history
+			nextPointHistoryID++
+			pointHistoryMux.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+// ポイント使用のロールバック
+func rollbackPoints(userID int, orderID int, points int) {
+	userMux.Lock()
+	defer userMux.Unlock()
+
+	if user, exists := users[userID]; exists {
+		user.CurrentPoints += points
+
+		// ロールバック履歴を記録（キャンセルとして）
+		pointHistoryMux.Lock()
+		history := &PointHistory{
+			ID:        nextPointHistoryID,
+			UserID:    userID,
+			OrderID:   orderID,
+			Type:      "rollback",
+			Amount:    points,
+			Balance:   user.CurrentPoints,
+			CreatedAt: time.Now(),
+		}
+		pointHistories[nextPointHistoryID] = history
+		nextPointHistoryID++
+		pointHistoryMux.Unlock()
+	}
+}
+
+// 注文で使用したまま戻していないポイント（used − rollback）をすべて戻す
+// 何度呼んでも二重には戻さないため、処理中の注文の後始末を複数の経路から行う場合に使う
+func returnHeldPoints(userID int, orderID int) int {
+	userMux.Lock()
+	defer userMux.Unlock()
+
+	user, exists := users[userID]
+	if !exists {
+		return 0
+	}
+
+	pointHistoryMux.Lock()
+	defer pointHistoryMux.Unlock()
+
+	held := 0
+	for _, history := range pointHistories {
+		if history.UserID != userID || history.OrderID != orderID {
+			continue
+		}
+		switch history.Type {
+		case "used":
+			held += history.Amount
+		case "rollback":
+			held -= history.Amount
+		}
+	}
+	if held <= 0 {
+		return 0
+	}
+
+	user.CurrentPoints += held
+	pointHistories[nextPointHistoryID] = &PointHistory{
+		ID:        nextPointHistoryID,
+		UserID:    userID,
+		OrderID:   orderID,
+		Type:      "rollback",
+		Amount:    held,
+		Balance:   user.CurrentPoints,
+		CreatedAt: time.Now(),
+	}
+	nextPointHistoryID++
+	return held
+}
+
+// 付与済みポイントの取り消し（残高が不足する場合は残高分のみ取り消す）
+func revokePoints(userID int, orderID int, points int) int {
+	userMux.Lock()
+	defer userMux.Unlock()
+
+	user, exists := users[userID]
+	if !exists {
+		return 0
+	}
+	if points > user.CurrentPoints {
+		points = user.CurrentPoints
+	}
+	if points <= 0 {
+		return 0
+	}
+	user.CurrentPoints -= points
+
+	// 取り消し履歴を記録
+	pointHistoryMux.Lock()
+	history := &PointHistory{
+		ID:        nextPointHistoryID,
+		UserID:    userID,
+		OrderID:   orderID,
+		Type:      "revoked",
+		Amount:    points,
+		Balance:   user.CurrentPoints,
+		CreatedAt: time.Now(),
+	}
+	pointHistories[nextPointHistoryID] = history
+	nextPointHistoryID++
+	pointHistoryMux.Unlock()
+	return points
+}
+
+// ハンドラー関数
+
+// 商品一覧取得（カテゴリフィルタ対応）
+func getProductsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	category := r.URL.Query().Get("category")
+
+	// 価格帯フィルタ（両端を含む）
+	minPrice, maxPrice := -1, -1
+	if v := r.URL.Query().Get("min_price"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			errorResponse(w, http.StatusBadRequest, "Invalid min_price")
+			return
+		}
+		minPrice = n
+	}
+	if v := r.URL.Query().Get("max_price"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			errorResponse(w, http.StatusBadRequest, "Invalid max_price")
+			return
+		}
+		maxPrice = n
+	}
+	if minPrice >= 0 && maxPrice >= 0 && minPrice > maxPrice {
+		errorResponse(w, http.StatusBadRequest, "min_price must not be greater than max_price")
+		return
+	}
+
+	// 在庫切れ商品を含めるか（デフォルトは含める）
+	includeOutOfStock := true
+	if v := r.URL.Query().Get("include_out_of_stock"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, "Invalid include_out_of_stock (must be true or false)")
+			return
+		}
+		includeOutOfStock = b
+	}
+
+	// 認証ユーザーを取得
+	user := getAuthUser(r)
+	var userID int
+	if user != nil {
+		userID = user.ID
+	}
+
+	cfg := currentConfig()
+	productMux.RLock()
+	defer productMux.RUnlock()
+
+	result := []ProductDetailResponseWithFavorite{}
+	for _, p := range products {
+		if minPrice >= 0 && p.Price < minPrice {
+			continue
+		}
+		if maxPrice >= 0 && p.Price > maxPrice {
+			continue
+		}
+		if category == "" || p.Category == category {
+			totalStock, stockDetails := getProductStock(p.ID)
+			if !includeOutOfStock && sellableStock(cfg, p, totalStock) <= 0 {
+				continue
+			}
+			isFavorite := false
+			if user != nil {
+				isFavorite = isProductInWishlist(userID, p.ID)
+			}
+			result = append(result, ProductDetailResponseWithFavorite{
+				ID:          p.ID,
+				Name:        p.Name,
+				Price:       p.Price,
+				Category:    p.Category,
+				TotalStock:  sellableStock(cfg, p, totalStock),
+				StockDetail: stockDetails,
+				IsFavorite:  isFavorite,
+
+				PreOrder:      isPreOrder(p),
+				AvailableFrom: availableFromPtr(p),
+
+				PriceTiers: p.PriceTiers,
+			})
+		}
+	}
+
+	jsonResponse(w, http.StatusOK, result)
+}
+
+// 商品詳細取得
+func getProductHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// URLから商品IDを取得
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 3 {
+		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	id, err := strconv.Atoi(parts[2])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	productMux.RLock()
+	product := products[id]
+	productMux.RUnlock()
+
+	if product == nil {
+		errorResponse(w, http.StatusNotFound, "Product not found")
+		return
+	}
+
+	// 認証ユーザーを取得
+	user := getAuthUser(r)
+	isFavorite := false
+	if user != nil {
+		isFavorite = isProductInWishlist(user.ID, product.ID)
+		recordProductView(user.ID, product.ID)
+	}
+
+	// 倉庫別在庫情報を取得
+	totalStock, stockDetails := getProductStock(product.ID)
+
+	cfg := currentConfig()
+	response := ProductDetailResponseWithFavorite{
+		ID:          product.ID,
+		Name:        product.Name,
+		Price:       product.Price,
+		Category:    product.Category,
+		TotalStock:  sellableStock(cfg, product, totalStock),
+		StockDetail: stockDetails,
+		IsFavorite:  isFavorite,
+
+		PreOrder:      isPreOrder(product),
+		AvailableFrom: availableFromPtr(product),
+
+		PriceTiers: product.PriceTiers,
+	}
+
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// 商品に適用できるクーポン一覧（商品ページのバッジ表示用）
+// 対象カテゴリが一致または無制限で、有効期間内かつ利用回数上限に達していないクーポンを返す
+// 初回購入限定クーポンは、認証済みで完了注文のないユーザーにのみ返す
+func getProductCouponsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// URLから商品IDを取得（/products/{id}/coupons）
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 || parts[3] != "coupons" {
+		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+	id, err := strconv.Atoi(parts[2])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	productMux.RLock()
+	product := products[id]
+	var price int
+	var category string
+	if product != nil {
+		price = product.Price
+		category = product.Category
+	}
+	productMux.RUnlock()
+
+	if product == nil {
+		errorResponse(w, http.StatusNotFound, "Product not found")
+		return
+	}
+
+	// 未認証でも利用可能（初回購入限定クーポンの判定にのみ使う）
+	user := getAuthUser(r)
+
+	var candidates []Coupon
+	couponMux.RLock()
+	for _, coupon := range coupons {
+		candidates = append(candidates, *coupon)
+	}
+	couponMux.RUnlock()
+
+	cfg := currentConfig()
+	now := time.Now()
+	result := []ProductCouponResponse{}
+	for i := range candidates {
+		coupon := &candidates[i]
+		if coupon.Category != "" && coupon.Category != category {
+			continue
+		}
+		if coupon.ValidFrom != nil && now.Before(*coupon.ValidFrom) {
+			continue
+		}
+		if coupon.ExpiresAt != nil && !now.Before(*coupon.ExpiresAt) {
+			continue
+		}
+		if code, _ := checkCouponEligibility(coupon, user); code != "" {
+			continue
+		}
+
+		unitDiscount := 0
+		if coupon.Type != "shipping" {
+			unitDiscount = calculateCouponDiscount(cfg, coupon, price)
+		}
+		result = append(result, ProductCouponResponse{Coupon: *coupon, UnitDiscount: unitDiscount})
+	}
+
+	// 割引額の大きい順（同額はコード順）
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].UnitDiscount != result[j].UnitDiscount {
+			return result[i].UnitDiscount > result[j].UnitDiscount
+		}
+		return result[i].Code < result[j].Code
+	})
+
+	jsonResponse(w, http.StatusOK, result)
+}
+
+// 期限切れ間近のクーポン一覧の期間（within 省略時）
+const defaultCouponExpiringWithin = 72 * time.Hour
+
+// 期限切れ間近のクーポン一覧（管理者のみ）
+// 有効期限（expires_at）が現在から within 以内のクーポンを期限の近い順に返す（期限切れ・無期限は対象外）
+func getExpiringCouponsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	within := defaultCouponExpiringWithin
+	if v := r.URL.Query().Get("within"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			errorResponse(w, http.StatusBadRequest, "Invalid within duration (e.g. 72h)")
+			return
+		}
+		within = d
+	}
+
+	now := time.Now()
+	deadline := now.Add(within)
+
+	response := []Coupon{}
+	couponMux.RLock()
+	for _, coupon := range coupons {
+		if coupon.ExpiresAt == nil || coupon.ExpiresAt.Before(now) || coupon.ExpiresAt.After(deadline) {
+			continue
+		}
+		response = append(response, *coupon)
+	}
+	couponMux.RUnlock()
+
+	sort.Slice(response, func(i, j int) bool {
+		if !response[i].ExpiresAt.Equal(*response[j].ExpiresAt) {
+			return response[i].ExpiresAt.Before(*response[j].ExpiresAt)
+		}
+		return response[i].Code < response[j].Code
+	})
+
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// カテゴリセールの作成（管理者のみ）
+func createCategorySaleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	var req CategorySale
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Category == "" {
+		errorResponse(w, http.StatusBadRequest, "Category is required")
+		return
+	}
+	// 100%割引は商品小計が0円になり注文できなくなるため受け付けない
+	if req.PercentOff <= 0 || req.PercentOff >= 100 {
+		errorResponse(w, http.StatusBadRequest, "percent_off must be between 1 and 99")
+		return
+	}
+	if req.ValidFrom.IsZero() || req.ValidUntil.IsZero() || !req.ValidUntil.After(req.ValidFrom) {
+		errorResponse(w, http.StatusBadRequest, "valid_until must be after valid_from")
+		return
+	}
+
+	categorySaleMux.Lock()
+	sale := &CategorySale{
+		ID:         nextCategorySaleID,
+		Category:   req.Category,
+		PercentOff: req.PercentOff,
+		ValidFrom:  req.ValidFrom,
+		ValidUntil: req.ValidUntil,
+	}
+	categorySales[sale.ID] = sale
+	nextCategorySaleID++
+	categorySaleMux.Unlock()
+
+	jsonResponse(w, http.StatusCreated, sale)
+}
+
+// カテゴリセール一覧（管理者のみ、期間外のものも含めてID順）
+func getCategorySalesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	response := []CategorySale{}
+	categorySaleMux.RLock()
+	for _, sale := range categorySales {
+		response = append(response, *sale)
+	}
+	categorySaleMux.RUnlock()
+	sort.Slice(response, func(i, j int) bool {
+		return response[i].ID < response[j].ID
+	})
+
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// カテゴリセールの削除（管理者のみ、期間中のセールを途中で終了する場合にも使う）
+func deleteCategorySaleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	// URLからセールIDを取得
+	saleID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/admin/category-sales/"))
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid sale ID")
+		return
+	}
+
+	categorySaleMux.Lock()
+	sale, exists := categorySales[saleID]
+	delete(categorySales, saleID)
+	categorySaleMux.Unlock()
+
+	if !exists {
+		errorResponse(w, http.StatusNotFound, "Category sale not found")
+		return
+	}
+
+	// 削除したセールを返す
+	jsonResponse(w, http.StatusOK, sale)
+}
+
+// 購入金額特典の作成（管理者のみ）
+func createGiftRuleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	var req GiftRule
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Threshold <= 0 {
+		errorResponse(w, http.StatusBadRequest, "threshold must be positive")
+		return
+	}
+
+	productMux.RLock()
+	_, exists := products[req.GiftProductID]
+	productMux.RUnlock()
+	if !exists {
+		errorResponse(w, http.StatusNotFound, fmt.Sprintf("Product %d not found", req.GiftProductID))
+		return
+	}
+
+	giftRuleMux.Lock()
+	rule := &GiftRule{
+		ID:            nextGiftRuleID,
+		Threshold:     req.Threshold,
+		GiftProductID: req.GiftProductID,
+	}
+	giftRules[rule.ID] = rule
+	nextGiftRuleID++
+	giftRuleMux.Unlock()
+
+	jsonResponse(w, http.StatusCreated, rule)
+}
+
+// 購入金額特典の一覧（管理者のみ、ID順）
+func getGiftRulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	response := []GiftRule{}
+	giftRuleMux.RLock()
+	for _, rule := range giftRules {
+		response = append(response, *rule)
+	}
+	giftRuleMux.RUnlock()
+	sort.Slice(response, func(i, j int) bool {
+		return response[i].ID < response[j].ID
+	})
+
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// 購入金額特典の削除（管理者のみ）
+func deleteGiftRuleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	// URLから特典IDを取得
+	ruleID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/admin/gift-rules/"))
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid gift rule ID")
+		return
+	}
+
+	giftRuleMux.Lock()
+	rule, exists := giftRules[ruleID]
+	delete(giftRules, ruleID)
+	giftRuleMux.Unlock()
+
+	if !exists {
+		errorResponse(w, http.StatusNotFound, "Gift rule not found")
+		return
+	}
+
+	// 削除した特典を返す
+	jsonResponse(w, http.StatusOK, rule)
+}
+
+// おすすめ商品一覧取得（在庫がある商品のみ、表示順の昇順）
+func getFeaturedProductsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	cfg := currentConfig()
+	productMux.RLock()
+	result := []FeaturedProductResponse{}
+	for _, p := range products {
+		if !p.Featured {
+			continue
+		}
+		totalStock, stockDetails := getProductStock(p.ID)
+		totalStock = sellableStock(cfg, p, totalStock)
+		if totalStock <= 0 {
+			continue
+		}
+		result = append(result, FeaturedProductResponse{
+			ProductDetailResponse: ProductDetailResponse{
+				ID:          p.ID,
+				Name:        p.Name,
+				Price:       p.Price,
+				Category:    p.Category,
+				TotalStock:  totalStock,
+				StockDetail: stockDetails,
+
+				PreOrder:      isPreOrder(p),
+				AvailableFrom: availableFromPtr(p),
+
+				PriceTiers: p.PriceTiers,
+			},
+			FeaturedRank: p.FeaturedRank,
+		})
+	}
+	productMux.RUnlock()
+
+	// 表示順の昇順（同順位は商品ID順）
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].FeaturedRank != result[j].FeaturedRank {
+			return result[i].FeaturedRank < result[j].FeaturedRank
+		}
+		return result[i].ID < result[j].ID
+	})
+
+	jsonResponse(w, http.StatusOK, result)
+}
+
+// おすすめ商品の設定・解除（管理者のみ）
+// PUT で設定（body: {"rank": N}）、DELETE で解除
+func setProductFeaturedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" && r.Method != "DELETE" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	// URLから商品IDを取得 (/admin/products/{id}/featured)
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 5 || parts[4] != "featured" {
+		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+	productID, err := strconv.Atoi(parts[3])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	var req struct {
+		Rank int `json:"rank"`
+	}
+	if r.Method == "PUT" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errorResponse(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		if req.Rank < 0 {
+			errorResponse(w, http.StatusBadRequest, "rank must not be negative")
+			return
+		}
+	}
+
+	productMux.Lock()
+	product := products[productID]
+	if product == nil {
+		productMux.Unlock()
+		errorResponse(w, http.StatusNotFound, "Product not found")
+		return
+	}
+	if r.Method == "PUT" {
+		product.Featured = true
+		product.FeaturedRank = req.Rank
+	} else {
+		product.Featured = false
+		product.FeaturedRank = 0
+	}
+	updated := *product
+	productMux.Unlock()
+
+	jsonResponse(w, http.StatusOK, updated)
+}
+
+// 商品作成（管理者のみ）
+func createProductHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	var req struct {
+		Name         string `json:"name"`
+		Price        int    `json:"price"`
+		Category     string `json:"category"`
+		InitialStock int    `json:"initial_stock"`          // 初期在庫
+		WarehouseID  int    `json:"warehouse_id,omitempty"` // 初期在庫の配置先（省略時はデフォルト倉庫）
+
+		AvailableFrom time.Time `json:"available_from,omitempty"` // 販売開始日時（RFC3339、省略時は即時販売）
+		SafetyStock   int       `json:"safety_stock,omitempty"`   // 安全在庫数（省略時は SAFETY_STOCK）
+
+		PriceTiers []PriceTier `json:"price_tiers,omitempty"` // 数量段階価格
+		ExternalID string      `json:"external_id,omitempty"` // 外部システムの商品ID（同じIDの再送は既存商品を返す）
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// バリデーション
+	if req.Name == "" || req.Price <= 0 || req.InitialStock < 0 || req.SafetyStock < 0 || req.Category == "" {
+		errorResponse(w, http.StatusBadRequest, "Invalid product data")
+		return
+	}
+	for _, tier := range req.PriceTiers {
+		if tier.MinQty <= 0 || tier.UnitPrice <= 0 {
+			errorResponse(w, http.StatusBadRequest, "Invalid price tier")
+			return
+		}
+	}
+
+	// 初期在庫の配置先倉庫を決定
+	cfg := currentConfig()
+	warehouseID := cfg.DefaultWarehouseID
+	if req.WarehouseID != 0 {
+		warehouseID = req.WarehouseID
+	}
+	if req.InitialStock > 0 || req.WarehouseID != 0 {
+		warehouseMux.RLock()
+		_, warehouseExists := warehouses[warehouseID]
+		warehouseMux.RUnlock()
+
+		if !warehouseExists {
+			if req.WarehouseID != 0 {
+				errorResponse(w, http.StatusBadRequest, "Warehouse not found")
+			} else {
+				// デフォルト倉庫の設定ミス
+				errorResponse(w, http.StatusInternalServerError,
+					fmt.Sprintf("Default warehouse %d does not exist; check DEFAULT_WAREHOUSE_ID", warehouseID))
+			}
+			return
+		}
+	}
+
+	productMux.Lock()
+	// 同じ外部IDの商品が既にあれば作成せずに返す（同期処理の再試行を安全にする）
+	if req.ExternalID != "" {
+		if existing := products[productsByExternalID[req.ExternalID]]; existing != nil {
+			productMux.Unlock()
+			jsonResponse(w, http.StatusOK, buildProductDetailResponse(cfg, existing))
+			return
+		}
+	}
+	product := Product{
+		ID:       nextProductID,
+		Name:     req.Name,
+		Price:    req.Price,
+		Category: req.Category,
+
+		AvailableFrom: req.AvailableFrom,
+		SafetyStock:   req.SafetyStock,
+
+		PriceTiers: req.PriceTiers,
+		ExternalID: req.ExternalID,
+	}
+	nextProductID++
+	products[product.ID] = &product
+	if product.ExternalID != "" {
+		productsByExternalID[product.ExternalID] = product.ID
+	}
+	productMux.Unlock()
+
+	// 初期在庫を配置先倉庫に設定
+	// 初期在庫が 0 の場合は在庫行を作成しない（数量 0 の行は stock_detail に表示されないため、
+	// 在庫の追加は /admin/stock/adjust または /admin/stock/import で行う）
+	if req.InitialStock > 0 {
+		if err := placeInitialStock(product.ID, warehouseID, req.InitialStock); err != nil {
+			// 在庫を配置できない場合は商品作成を取り消す（在庫を宙に浮かせない）
+			deleteProduct(product.ID)
+			if errors.Is(err, errWarehouseCapacityExceeded) {
+				errorResponse(w, http.StatusConflict,
+					fmt.Sprintf("Warehouse %d capacity exceeded; product was not created", warehouseID))
+			} else {
+				// 確認後に倉庫が削除された場合
+				errorResponse(w, http.StatusInternalServerError,
+					fmt.Sprintf("Warehouse %d no longer exists; product was not created", warehouseID))
+			}
+			return
+		}
+	}
+
+	jsonResponse(w, http.StatusCreated, buildProductDetailResponse(cfg, &product))
+}
+
+// 商品詳細レスポンスを組み立てる（在庫情報を含める）
+func buildProductDetailResponse(cfg Config, product *Product) ProductDetailResponse {
+	totalStock, stockDetails := getProductStock(product.ID)
+	return ProductDetailResponse{
+		ID:          product.ID,
+		Name:        product.Name,
+		Price:       product.Price,
+		Category:    product.Category,
+		TotalStock:  sellableStock(cfg, product, totalStock),
+		StockDetail: stockDetails,
+
+		PreOrder:      isPreOrder(product),
+		AvailableFrom: availableFromPtr(product),
+
+		PriceTiers: product.PriceTiers,
+		ExternalID: product.ExternalID,
+	}
+}
+
+// ユーザー登録
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if req.Username == "" || req.Password == "" {
+		errorResponse(w, http.StatusBadRequest, "Username and password required")
+		return
+	}
+
+	userMux.Lock()
+	defer userMux.Unlock()
+
+	// ユーザー名の重複チェック
+	if usersByName[req.Username] != nil {
+		errorResponse(w, http.StatusConflict, "Username already exists")
+		return
+	}
+
+	// パスワードハッシュ化
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, "Failed to process password")
+		return
+	}
+
+	user := &User{
+		ID:               nextUserID,
+		Username:         req.Username,
+		PasswordHash:     string(hash),
+		IsAdmin:          false,
+		CurrentPoints:    0,
+		TotalSpentAmount: 0,
+		MemberRank:       "Normal",
+		CreatedAt:        time.Now(),
+	}
+
+	nextUserID++
+	users[user.ID] = user
+	usersByName[user.Username] = user
+
+	// セッション発行
+	token := createSession(user)
+
+	user.Token = token
+	jsonResponse(w, http.StatusCreated, user)
+}
+
+// ユーザー名の空き確認（登録前のバリデーション用、何も作成しない）
+// ユーザー名の列挙を防ぐため、クライアントIPごとに回数を制限する
+func checkRegisterAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	cfg := currentConfig()
+	if !allowRegisterCheck(cfg, clientIP(r), time.Now()) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(cfg.RegisterCheckRateWindow.Seconds())))
+		errorResponse(w, http.StatusTooManyRequests, "Too many requests")
+		return
+	}
+
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		errorResponse(w, http.StatusBadRequest, "username is required")
+		return
+	}
+
+	userMux.RLock()
+	taken := usersByName[username] != nil
+	userMux.RUnlock()
+
+	jsonResponse(w, http.StatusOK, map[string]bool{
+		"username_available": !taken,
+	})
+}
+
+// ログイン
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userMux.RLock()
+	user := usersByName[req.Username]
+	userMux.RUnlock()
+
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Invalid credentials")
+		return
+	}
+
+	// パスワード検証
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		errorResponse(w, http.StatusUnauthorized, "Invalid credentials")
+		return
+	}
+
+	// セッション発行
+	token := createSession(user)
+
+	response := *user
+	response.Token = token
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// 注文作成
+func createOrderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req CreateOrderRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	placeOrder(w, r, user, req)
+}
+
+// 注文を作成して決済する（エラー時も含めてレスポンスを書き込む）
+// 注文が完了した場合のみ true を返す
+func placeOrder(w http.ResponseWriter, r *http.Request, user *User, req CreateOrderRequest) bool {
+	if len(req.Items) == 0 {
+		errorResponse(w, http.StatusBadRequest, "No items in order")
+		return false
+	}
+
+	// この注文の処理中は同じ設定を使う（価格計算と記録する適用ルールを一致させる）
+	cfg := currentConfig()
+
+	// 明細数の上限チェック（重い注文を処理前に拒否する）
+	if len(req.Items) > cfg.MaxOrderItems {
+		errorResponse(w, http.StatusBadRequest, "Too many items")
+		return false
+	}
+
+	// ポイント使用のバリデーション
+	if req.UsePoints < 0 {
+		errorResponse(w, http.StatusBadRequest, "Invalid use_points value")
+		return false
+	}
+
+	destination, err := resolveDestination(req.Destination.Latitude, req.Destination.Longitude, req.Destination.PostalCode)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+
+	giftRecipient, giftMessage, err := validateGiftOrder(req)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+
+	userMux.RLock()
+	currentUserPoints := user.CurrentPoints
+	currentUserRank := user.MemberRank
+	userCreatedAt := user.CreatedAt
+	userMux.RUnlock()
+
+	if req.UsePoints > currentUserPoints {
+		errorResponse(w, http.StatusBadRequest, fmt.Sprintf("Insufficient points. Available: %d, Requested: %d", currentUserPoints, req.UsePoints))
+		return false
+	}
+
+	// クーポンコードのバリデーション
+	var appliedCoupon *Coupon
+	if req.CouponCode != "" {
+		couponMux.RLock()
+		appliedCoupon = coupons[req.CouponCode]
+		couponMux.RUnlock()
+
+		// 存在しないコードは404、存在するが条件を満たさない場合は422（商品確認後に判定）
+		if appliedCoupon == nil {
+			errorResponseWithCode(w, http.StatusNotFound, "coupon_not_found", "Coupon not found")
+			return false
+		}
+	}
+
+	// 在庫チェックと基本価格計算
+	subtotal := 0
+	listSubtotal := 0 // カテゴリセール適用前の商品小計（割引上限の判定用）
+	orderProducts := make([]*Product, len(req.Items))
+	orderCategories := make(map[string]bool)
+
+	// 在庫の事前確認（引当は後で行う）
+	availability := checkStockAvailability(cfg, req.Items)
+
+	// 有効なカテゴリセール（クーポンより先に単価へ反映する）
+	sales := activeCategorySales(time.Now())
+	appliedSales := make(map[string]int)
+
+	// 商品の存在確認と基本価格計算
+	productMux.RLock()
+	for i, item := range req.Items {
+		if item.Quantity <= 0 {
+			productMux.RUnlock()
+			errorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid quantity for item %d", i))
+			return false
+		}
+
+		product := products[item.ProductID]
+		if product == nil {
+			productMux.RUnlock()
+			errorResponse(w, http.StatusNotFound, fmt.Sprintf("Product %d not found", item.ProductID))
+			return false
+		}
+
+		// 販売開始前の商品は注文不可
+		if isPreOrder(product) {
+			productMux.RUnlock()
+			errorResponse(w, http.StatusBadRequest, "Not yet available")
+			return false
+		}
+
+		// 総在庫数を確認
+		if !availability[i].Sufficient {
+			productMux.RUnlock()
+			errorResponse(w, http.StatusBadRequest,
+				fmt.Sprintf("Insufficient stock for product %s (available: %d, requested: %d)",
+					product.Name, availability[i].Available, item.Quantity))
+			return false
+		}
+
+		orderProducts[i] = product
+		// 注文時点の単価を記録（後の価格変更の影響を受けないように）
+		// 数量段階価格がある場合は数量に応じた単価を適用し、カテゴリセールの割引は明細単位で記録する
+		req.Items[i].UnitPrice = unitPriceFor(product, item.Quantity)
+		req.Items[i].SaleDiscount = saleDiscountFor(cfg, product, item.Quantity, sales)
+		if percent := sales[product.Category]; percent > 0 {
+			appliedSales[product.Category] = percent
+		}
+		req.Items[i].ProductName = product.Name
+		req.Items[i].IsGift = false // プレゼント明細はサーバー側でのみ追加する
+		subtotal += orderItemTotal(req.Items[i])
+		listSubtotal += req.Items[i].UnitPrice * item.Quantity
+		orderCategories[product.Category] = true
+	}
+	productMux.RUnlock()
+
+	// 商品小計が0円の注文は受け付けない（支払額0円はポイント等で全額充当した場合のみ）
+	if subtotal <= 0 {
+		errorResponse(w, http.StatusBadRequest, "Order subtotal must be positive")
+		return false
+	}
+
+	// 購入金額特典のプレゼント（在庫の引当は決済成功後）
+	gifts := selectGiftItems(subtotal)
+
+	// クーポンの利用条件（有効期間・最低注文金額・対象カテゴリ）
+	if appliedCoupon != nil {
+		if code, message := checkCouponApplicable(appliedCoupon, subtotal, orderCategories, time.Now()); code != "" {
+			errorResponseWithCode(w, http.StatusUnprocessableEntity, code, message)
+			return false
+		}
+		if code, message := checkCouponEligibility(appliedCoupon, user); code != "" {
+			errorResponseWithCode(w, http.StatusUnprocessableEntity, code, message)
+			return false
+		}
+	}
+
+	// クーポンの自動適用（コード指定がある場合はそちらを優先）
+	couponAutoApplied := false
+	if appliedCoupon == nil && req.AutoCoupon {
+		if appliedCoupon = selectBestCoupon(cfg, subtotal, listSubtotal-subtotal, orderCategories, currentUserRank, req.UsePoints, user); appliedCoupon != nil {
+			req.CouponCode = appliedCoupon.Code
+			couponAutoApplied = true
+		}
+	}
+
+	// 重複注文の検出（ダブルクリック対策）
+	// Idempotency-Key ヘッダーまたは allow_duplicate の指定がある場合は対象外
+	orderCompleted := false
+	if cfg.DuplicateOrderWindow > 0 && r.Header.Get("Idempotency-Key") == "" && !req.AllowDuplicate {
+		fingerprint := orderFingerprint(req.Items)
+		if !registerRecentOrder(user.ID, fingerprint, cfg.DuplicateOrderWindow) {
+			errorResponse(w, http.StatusConflict, "Duplicate order: an identical order was just placed")
+			return false
+		}
+		defer func() {
+			if !orderCompleted {
+				clearRecentOrder(user.ID, fingerprint)
+			}
+		}()
+	}
+
+	// 支払い金額の算出
+	totals := calculateOrderTotalsWithSale(cfg, subtotal, listSubtotal-subtotal, currentUserRank, appliedCoupon, req.UsePoints)
+	totalPrice := totals.TotalPrice
+	earnedPoints := totals.EarnedPoints
+
+	// 注文IDを先に生成（決済処理で必要）
+	orderID := nextOrderID
+
+	// ポイントを使用（決済前に仮で減算）
+	// 実際に支払額から差し引かれる分のみを消費し、余剰分は消費しない
+	pointsToUse := totals.UsedPoints
+	pointsUsed := false
+	if pointsToUse > 0 {
+		pointsUsed = usePoints(user.ID, orderID, pointsToUse)
+		if !pointsUsed {
+			errorResponse(w, http.StatusInternalServerError, "Failed to use points")
+			return false
+		}
+	}
+
+	// 決済処理を実行（在庫減算前）
+	// ポイント等で支払額が0円の場合は決済ゲートウェイを呼ばずに決済成功として扱う
+	var paymentResult PaymentResult
+	var paymentErr error
+	if totalPrice == 0 {
+		paymentResult = PaymentResult{Success: true, Message: "No payment required"}
+	} else {
+		paymentResult, paymentErr = processPaymentWithTimeout(r.Context(), cfg.PaymentTimeout, totalPrice, orderID)
+	}
+
+	// 注文オブジェクトを作成
+	order := &Order{
+		ID:             orderID,
+		UserID:         user.ID,
+		Items:          req.Items,
+		TotalPrice:     totalPrice,
+		ShippingFee:    totals.ShippingFee,
+		DiscountAmount: totals.CouponDiscount,
+		AppliedCoupon:  req.CouponCode,
+		CreatedAt:      time.Now(),
+		EarnedPoints:   earnedPoints,
+		UsedPoints:     totals.UsedPoints,
+		PointsDiscount: totals.PointsDiscount,
+		RankDiscount:   totals.RankDiscount,
+		Tax:            totals.Tax,
+
+		AppliedBenefits: buildAppliedBenefits(cfg, currentUserRank, appliedCoupon),
+		Destination:     destination,
+
+		IsGift:        req.IsGift,
+		GiftRecipient: giftRecipient,
+		GiftMessage:   giftMessage,
+	}
+	order.AppliedBenefits.CouponAutoApplied = couponAutoApplied
+	if len(appliedSales) > 0 {
+		order.AppliedBenefits.CategorySales = appliedSales
+	}
+	order.AppliedBenefits.DiscountCapped = totals.DiscountCapped
+	order.OrderFlags = detectOrderFlags(cfg, order.Items, order.UsedPoints, order.TotalPrice, userCreatedAt, order.CreatedAt)
+	if totals.DiscountCapped {
+		order.OrderFlags = append(order.OrderFlags, orderFlagDiscountCapped)
+	}
+
+	if paymentErr != nil {
+		// タイムアウト・キャンセル時は決済失敗として扱い、在庫は減らさない
+		if pointsUsed {
+			rollbackPoints(user.ID, orderID, pointsToUse)
+		}
+
+		setOrderStatus(order, "payment_failed", user.ID)
+		orderMux.Lock()
+		nextOrderID++
+		orders[order.ID] = order
+		orderMux.Unlock()
+
+		if errors.Is(paymentErr, context.DeadlineExceeded) {
+			errorResponse(w, http.StatusGatewayTimeout, "Payment timed out")
+		} else {
+			errorResponse(w, http.StatusServiceUnavailable, "Payment cancelled")
+		}
+		return false
+	}
+
+	if paymentResult.Success {
+		// 決済成功時のみ在庫を減らす
+		stockAllocations, allAllocated := allocateOrderStock(cfg, req.Items, destination)
+		if !allAllocated {
+			// 在庫割り当て失敗（競合状態などで発生する可能性あり）
+			// ポイントをロールバック
+			if pointsUsed {
+				rollbackPoints(user.ID, orderID, pointsToUse)
+			}
+			setOrderStatus(order, "payment_failed", user.ID)
+			orderMux.Lock()
+			nextOrderID++
+			orders[order.ID] = order
+			orderMux.Unlock()
+			errorResponse(w, http.StatusConflict, "Stock allocation failed. Please retry.")
+			return false
+		}
+
+		setOrderStatus(order, "completed", user.ID)
+		order.TransactionID = paymentResult.TransactionID
+		order.Allocations = stockAllocations
+		addGiftItems(cfg, order, gifts)
+		orderCompleted = true
+
+		// ポイント付与と累計購入金額・ランクの更新
+		applyOrderCompletion(order)
+
+		// 更新後のユーザー情報を取得
+		userMux.RLock()
+		updatedUser := users[user.ID]
+		newTotalPoints := updatedUser.CurrentPoints
+		newRank := updatedUser.MemberRank
+		userMux.RUnlock()
+
+		// 注文を保存（トランザクションIDの索引も更新）
+		orderMux.Lock()
+		nextOrderID++
+		orders[order.ID] = order
+		if order.TransactionID != "" {
+			ordersByTransaction[order.TransactionID] = order.ID
+		}
+		orderMux.Unlock()
+
+		// 成功レスポンスにポイント情報を含める（トランザクションIDは注文に保存済み）
+		response := struct {
+			*Order
+			NewTotalPoints int    `json:"new_total_points"`
+			CurrentRank    string `json:"current_rank"`
+		}{
+			Order:          order,
+			NewTotalPoints: newTotalPoints,
+			CurrentRank:    newRank,
+		}
+
+		jsonResponse(w, http.StatusCreated, response)
+	} else {
+		// 決済失敗時は在庫を減らさない
+		// ポイントの使用もロールバック
+		if pointsUsed {
+			rollbackPoints(user.ID, orderID, pointsToUse)
+		}
+
+		setOrderStatus(order, "payment_failed", user.ID)
+
+		// 失敗した注文も記録（監査目的）
+		orderMux.Lock()
+		nextOrderID++
+		orders[order.ID] = order
+		orderMux.Unlock()
+
+		// エラーレスポンス
+		errorResponse(w, http.StatusPaymentRequired,
+			fmt.Sprintf("Payment failed: %s", paymentResult.Message))
+	}
+	return orderCompleted
+}
+
+// 送料の見積もり（注文は作成しない）
+// 注文作成と同じ価格計算（calculateOrderTotals）の送料部分を返す。認証済みの場合は会員ランクの特典を反映する
+// 送料は配送先・出荷倉庫によらず一律のため、配送先の指定は受け付けない
+func shippingEstimateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req struct {
+		Items []OrderItem `json:"items"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Items) == 0 {
+		errorResponse(w, http.StatusBadRequest, "No items in order")
+		return
+	}
+	cfg := currentConfig()
+	if len(req.Items) > cfg.MaxOrderItems {
+		errorResponse(w, http.StatusBadRequest, "Too many items")
+		return
+	}
+
+	// 未認証の場合は通常会員として計算する
+	rank := "Normal"
+	if user := getAuthUser(r); user != nil {
+		userMux.RLock()
+		rank = user.MemberRank
+		userMux.RUnlock()
+	}
+
+	// 商品小計（数量段階価格・カテゴリセールを適用）
+	subtotal := 0
+	listSubtotal := 0
+	sales := activeCategorySales(time.Now())
+	productMux.RLock()
+	for i, item := range req.Items {
+		if item.Quantity <= 0 {
+			productMux.RUnlock()
+			errorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid quantity for item %d", i))
+			return
+		}
+		product := products[item.ProductID]
+		if product == nil {
+			productMux.RUnlock()
+			errorResponse(w, http.StatusNotFound, fmt.Sprintf("Product %d not found", item.ProductID))
+			return
+		}
+		listPrice := unitPriceFor(product, item.Quantity) * item.Quantity
+		subtotal += listPrice - saleDiscountFor(cfg, product, item.Quantity, sales)
+		listSubtotal += listPrice
+	}
+	productMux.RUnlock()
+
+	freeShippingThreshold := cfg.FreeShippingThreshold
+	totals := calculateOrderTotalsWithSale(cfg, subtotal, listSubtotal-subtotal, rank, nil, 0)
+	subtotalWithTax := totals.Subtotal - totals.RankDiscount + totals.Tax
+	response := ShippingEstimateResponse{
+		Subtotal:              totals.Subtotal,
+		SubtotalWithTax:       subtotalWithTax,
+		ShippingFee:           totals.ShippingFee,
+		FreeShipping:          totals.ShippingFee == 0,
+		FreeShippingByRank:    hasFreeShippingRank(rank),
+		FreeShippingThreshold: freeShippingThreshold,
+	}
+	if !response.FreeShipping {
+		response.AmountToFreeShipping = freeShippingThreshold - subtotalWithTax
+	}
+
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// 注文内容から不正の疑いのシグナルを検出する（しきい値は注文の処理に使う設定 cfg の FRAUD_*）
+// 登録日時が不明（ゼロ値）のアカウントは新規として扱わない
+func detectOrderFlags(cfg Config, items []OrderItem, usedPoints, totalPrice int, accountCreatedAt, now time.Time) []string {
+	flags := []string{}
+
+	if cfg.FraudHighQuantity > 0 {
+		for _, item := range items {
+			if item.Quantity >= cfg.FraudHighQuantity {
+				flags = append(flags, orderFlagHighQuantity)
+				break
+			}
+		}
+	}
+
+	if cfg.FraudLargePointsRedemption > 0 && usedPoints >= cfg.FraudLargePointsRedemption {
+		flags = append(flags, orderFlagLargePointsRedemption)
+	}
+
+	if cfg.FraudNewAccountOrderAmount > 0 && !accountCreatedAt.IsZero() &&
+		now.Sub(accountCreatedAt) < cfg.FraudNewAccountAge && totalPrice >= cfg.FraudNewAccountOrderAmount {
+		flags = append(flags, orderFlagNewAccountLargeOrder)
+	}
+
+	return flags
+}
+
+// 管理者向けの注文レスポンスを組み立てる
+func buildAdminOrderResponse(order *Order) AdminOrderResponse {
+	flags := order.OrderFlags
+	if flags == nil {
+		flags = []string{}
+	}
+	return AdminOrderResponse{Order: order, OrderFlags: flags}
+}
+
+// 注文した場合の獲得ポイントの見積もり（注文は作成しない）
+// 注文作成と同じ価格計算（calculateOrderTotals）を使い、在庫は確認しない
+func pointsPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req CreateOrderRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Items) == 0 {
+		errorResponse(w, http.StatusBadRequest, "No items in order")
+		return
+	}
+	cfg := currentConfig()
+	if len(req.Items) > cfg.MaxOrderItems {
+		errorResponse(w, http.StatusBadRequest, "Too many items")
+		return
+	}
+	if req.UsePoints < 0 {
+		errorResponse(w, http.StatusBadRequest, "Invalid use_points value")
+		return
+	}
+
+	userMux.RLock()
+	currentUserPoints := user.CurrentPoints
+	currentUserRank := user.MemberRank
+	userMux.RUnlock()
+
+	if req.UsePoints > currentUserPoints {
+		errorResponse(w, http.StatusBadRequest, fmt.Sprintf("Insufficient points. Available: %d, Requested: %d", currentUserPoints, req.UsePoints))
+		return
+	}
+
+	// 商品小計（数量段階価格・カテゴリセールを適用）
+	subtotal := 0
+	listSubtotal := 0
+	categories := make(map[string]bool)
+	sales := activeCategorySales(time.Now())
+	productMux.RLock()
+	for i, item := range req.Items {
+		if item.Quantity <= 0 {
+			productMux.RUnlock()
+			errorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid quantity for item %d", i))
+			return
+		}
+		product := products[item.ProductID]
+		if product == nil {
+			productMux.RUnlock()
+			errorResponse(w, http.StatusNotFound, fmt.Sprintf("Product %d not found", item.ProductID))
+			return
+		}
+		listPrice := unitPriceFor(product, item.Quantity) * item.Quantity
+		subtotal += listPrice - saleDiscountFor(cfg, product, item.Quantity, sales)
+		listSubtotal += listPrice
+		categories[product.Category] = true
+	}
+	productMux.RUnlock()
+
+	// クーポン（注文作成と同じ判定）
+	var coupon *Coupon
+	if req.CouponCode != "" {
+		couponMux.RLock()
+		coupon = coupons[req.CouponCode]
+		couponMux.RUnlock()
+		if coupon == nil {
+			errorResponseWithCode(w, http.StatusNotFound, "coupon_not_found", "Coupon not found")
+			return
+		}
+		if code, message := checkCouponApplicable(coupon, subtotal, categories, time.Now()); code != "" {
+			errorResponseWithCode(w, http.StatusUnprocessableEntity, code, message)
+			return
+		}
+		if code, message := checkCouponEligibility(coupon, user); code != "" {
+			errorResponseWithCode(w, http.StatusUnprocessableEntity, code, message)
+			return
+		}
+	} else if req.AutoCoupon {
+		coupon = selectBestCoupon(cfg, subtotal, listSubtotal-subtotal, categories, currentUserRank, req.UsePoints, user)
+	}
+
+	totals := calculateOrderTotalsWithSale(cfg, subtotal, listSubtotal-subtotal, currentUserRank, coupon, req.UsePoints)
+	response := PointsPreviewResponse{
+		EarnedPoints:      totals.EarnedPoints,
+		PointsRatePercent: cfg.PointsRatePercent,
+		PointsRounding:    cfg.PointsRounding,
+		Totals:            totals,
+	}
+	if coupon != nil {
+		response.AppliedCoupon = coupon.Code
+	}
+
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// 注文一覧取得（ユーザー自身の注文のみ）
+func getOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	orderMux.RLock()
+	defer orderMux.RUnlock()
+
+	userOrders := []*Order{}
+	for _, order := range orders {
+		if order.UserID == user.ID {
+			userOrders = append(userOrders, order)
+		}
+	}
+
+	jsonResponse(w, http.StatusOK, userOrders)
+}
+
+// 注文キャンセル（注文者本人はキャンセル受付期間内のみ、管理者は期間外でも可）
+func cancelOrderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// URLから注文IDを取得（/orders/{id}/cancel）
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 || parts[3] != "cancel" {
+		errorResponse(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	orderID, err := strconv.Atoi(parts[2])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !validCancelReasons[req.Reason] {
+		errorResponse(w, http.StatusBadRequest, "Invalid reason (must be customer_request, out_of_stock, fraud or other)")
+		return
+	}
+
+	// 状態の確認と更新は同じロック内で行い、二重キャンセルを防ぐ
+	orderMux.Lock()
+	order := orders[orderID]
+
+	// 他人の注文は存在を明かさない
+	if order == nil || (order.UserID != user.ID && !user.IsAdmin) {
+		orderMux.Unlock()
+		errorResponse(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	// 決済済みで未出荷の注文のみキャンセル可能
+	if order.Status != "completed" {
+		orderMux.Unlock()
+		errorResponse(w, http.StatusConflict, fmt.Sprintf("Order cannot be cancelled (status: %s)", order.Status))
+		return
+	}
+
+	if !user.IsAdmin && time.Since(order.CreatedAt) > currentConfig().CancellationWindow {
+		orderMux.Unlock()
+		errorResponse(w, http.StatusForbidden, "Cancellation window expired")
+		return
+	}
+
+	now := time.Now()
+	setOrderStatus(order, "cancelled", user.ID)
+	order.CancelledAt = &now
+	order.CancelReason = req.Reason
+	allocations := order.Allocations
+	response := lockedJSON(order)
+	orderMux.Unlock()
+
+	// 在庫を戻し、ポイントと累計購入金額を元に戻す
+	// 決済の返金は決済ゲートウェイ側で別途行う
+	releaseStock(allocations)
+	if order.UsedPoints > 0 {
+		rollbackPoints(order.UserID, order.ID, order.UsedPoints)
+	}
+	if order.EarnedPoints > 0 {
+		revokePoints(order.UserID, order.ID, order.EarnedPoints)
+	}
+	updateUserPurchaseAmountAndRank(order.UserID, -order.TotalPrice)
+
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// 一部返金（管理者のみ）
+// 指定した明細の在庫を戻し、支払額・使用ポイント・付与ポイントを明細金額の割合で按分して返す
+// 端数は累計で計算し、全明細を返金した時点で支払額・ポイントの全額が戻るようにする
+// 決済の返金は決済ゲートウェイ側で別途行う
+func refundOrderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	// URLから注文IDを取得（/orders/{id}/refund）
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 || parts[3] != "refund" {
+		errorResponse(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	orderID, err := strconv.Atoi(parts[2])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var req struct {
+		Items []RefundLine `json:"items"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Items) == 0 {
+		errorResponse(w, http.StatusBadRequest, "No items to refund")
+		return
+	}
+
+	// 同じ商品の指定はまとめる
+	requested := make(map[int]int)
+	for i, line := range req.Items {
+		if line.Quantity <= 0 {
+			errorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid quantity for item %d", i))
+			return
+		}
+		requested[line.ProductID] += line.Quantity
+	}
+
+	// 状態の確認と返金の記録は同じロック内で行い、二重返金を防ぐ
+	orderMux.Lock()
+	order := orders[orderID]
+	if order == nil {
+		orderMux.Unlock()
+		errorResponse(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	if !isCompletedSale(order) {
+		orderMux.Unlock()
+		errorResponse(w, http.StatusConflict, fmt.Sprintf("Order cannot be refunded (status: %s)", order.Status))
+		return
+	}
+
+	// 注文数量・返金済み数量・明細金額を商品ごとに集計
+	ordered := make(map[int]int)
+	lineValue := make(map[int]int)
+	orderValue := 0
+	for _, item := range order.Items {
+		ordered[item.ProductID] += item.Quantity
+		lineValue[item.ProductID] += orderItemTotal(item)
+		orderValue += orderItemTotal(item)
+	}
+	refunded := make(map[int]int)
+	for _, refund := range order.Refunds {
+		for _, line := range refund.Items {
+			refunded[line.ProductID] += line.Quantity
+		}
+	}
+
+	productIDs := make([]int, 0, len(requested))
+	for productID := range requested {
+		productIDs = append(productIDs, productID)
+	}
+	sort.Ints(productIDs)
+
+	// 返金数量が返金可能な数量（注文数量 - 返金済み数量）を超えていないか確認
+	for _, productID := range productIDs {
+		if remaining := ordered[productID] - refunded[productID]; requested[productID] > remaining {
+			orderMux.Unlock()
+			errorResponse(w, http.StatusBadRequest,
+				fmt.Sprintf("Refund quantity for product %d exceeds refundable quantity (%d)", productID, remaining))
+			return
+		}
+	}
+
+	// 返金前後の返金済み明細金額から按分額を求める
+	valueOf := func(quantities map[int]int) int {
+		value := 0
+		for productID, quantity := range quantities {
+			value += lineValue[productID] * quantity / ordered[productID]
+		}
+		return value
+	}
+	after := make(map[int]int)
+	for productID, quantity := range refunded {
+		after[productID] = quantity
+	}
+	for productID, quantity := range requested {
+		after[productID] += quantity
+	}
+	allRefunded := true
+	for productID, quantity := range ordered {
+		if after[productID] < quantity {
+			allRefunded = false
+		}
+	}
+	prorate := func(total int) int {
+		if orderValue <= 0 {
+			return 0
+		}
+		if allRefunded {
+			return total - total*valueOf(refunded)/orderValue
+		}
+		return total*valueOf(after)/orderValue - total*valueOf(refunded)/orderValue
+	}
+
+	refund := OrderRefund{
+		ID:             len(order.Refunds) + 1,
+		Items:          make([]RefundLine, 0, len(productIDs)),
+		Amount:         prorate(order.TotalPrice),
+		ReturnedPoints: prorate(order.UsedPoints),
+		RevokedPoints:  prorate(order.EarnedPoints),
+		RefundedAt:     time.Now(),
+		RefundedBy:     user.ID,
+	}
+
+	// 返金する数量分の引当を注文から外す（倉庫ID順）
+	released := make(map[int]map[int]int)
+	for _, productID := range productIDs {
+		quantity := requested[productID]
+		refund.Items = append(refund.Items, RefundLine{ProductID: productID, Quantity: quantity})
+
+		byWarehouse := order.Allocations[productID]
+		warehouseIDs := make([]int, 0, len(byWarehouse))
+		for warehouseID := range byWarehouse {
+			warehouseIDs = append(warehouseIDs, warehouseID)
+		}
+		sort.Ints(warehouseIDs)
+		for _, warehouseID := range warehouseIDs {
+			if quantity == 0 {
+				break
+			}
+			take := byWarehouse[warehouseID]
+			if take > quantity {
+				take = quantity
+			}
+			if released[productID] == nil {
+				released[productID] = make(map[int]int)
+			}
+			released[productID][warehouseID] += take
+			byWarehouse[warehouseID] -= take
+			if byWarehouse[warehouseID] == 0 {
+				delete(byWarehouse, warehouseID)
+			}
+			quantity -= take
+		}
+	}
+
+	order.Refunds = append(order.Refunds, refund)
+	// 全明細を返金した注文は refunded（売上として数えない）、それ以外は partially_refunded
+	status := "partially_refunded"
+	if allRefunded {
+		status = "refunded"
+	}
+	if order.Status != status {
+		setOrderStatus(order, status, user.ID)
+	}
+	response := lockedJSON(order)
+	orderMux.Unlock()
+
+	// 在庫を戻し、ポイントと累計購入金額を按分して戻す
+	releaseStock(released)
+	if refund.ReturnedPoints > 0 {
+		rollbackPoints(order.UserID, order.ID, refund.ReturnedPoints)
+	}
+	if refund.RevokedPoints > 0 {
+		revokePoints(order.UserID, order.ID, refund.RevokedPoints)
+	}
+	updateUserPurchaseAmountAndRank(order.UserID, -refund.Amount)
+
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// 通貨記号（未登録の通貨はコードをそのまま表示）
+var currencySymbols = map[string]string{
+	"JPY": "¥",
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+}
+
+// ロケールごとの桁区切り文字
+var localeGroupSeparators = map[string]string{
+	"ja-JP": ",",
+	"en-US": ",",
+	"en-GB": ",",
+	"de-DE": ".",
+	"fr-FR": " ",
+}
+
+// ロケールごとの小数点（未登録のロケールは "."）
+var localeDecimalSeparators = map[string]string{
+	"de-DE": ",",
+	"fr-FR": ",",
+}
+
+// 金額を表示用の文字列にする（例: 4900 -> "¥4,900"、補助単位2桁のUSDでは 490000 -> "$4,900.00"）
+func formatMoney(cfg Config, amount int) string {
+	symbol, ok := currencySymbols[cfg.Currency]
+	if !ok {
+		symbol = cfg.Currency + " "
+	}
+	separator, ok := localeGroupSeparators[cfg.MoneyLocale]
+	if !ok {
+		separator = ","
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	// 補助単位を分ける
+	scale := 1
+	for i := 0; i < cfg.CurrencyMinorUnits; i++ {
+		scale *= 10
+	}
+	major, minor := amount/scale, amount%scale
+
+	// 下3桁ずつ区切る
+	digits := strconv.Itoa(major)
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(separator)
+		}
+		b.WriteRune(d)
+	}
+
+	if cfg.CurrencyMinorUnits > 0 {
+		decimal, ok := localeDecimalSeparators[cfg.MoneyLocale]
+		if !ok {
+			decimal = "."
+		}
+		b.WriteString(decimal)
+		b.WriteString(fmt.Sprintf("%0*d", cfg.CurrencyMinorUnits, minor))
+	}
+	return sign + symbol + b.String()
+}
+
+// 領収書に表示用の金額文字列を追加する（すべての金額を同じ設定 cfg で整形する）
+func addFormattedAmounts(cfg Config, receipt *OrderReceipt) {
+	receipt.Formatted = map[string]string{
+		"items_subtotal":  formatMoney(cfg, receipt.ItemsSubtotal),
+		"rank_discount":   formatMoney(cfg, receipt.RankDiscount),
+		"tax":             formatMoney(cfg, receipt.Tax),
+		"shipping_fee":    formatMoney(cfg, receipt.ShippingFee),
+		"coupon_discount": formatMoney(cfg, receipt.CouponDiscount),
+		"points_used":     formatMoney(cfg, receipt.PointsUsed),
+		"points_discount": formatMoney(cfg, receipt.PointsDiscount),
+		"total_price":     formatMoney(cfg, receipt.TotalPrice),
+	}
+	for i := range receipt.LineItems {
+		line := &receipt.LineItems[i]
+		line.FormattedUnitPrice = formatMoney(cfg, line.UnitPrice)
+		line.FormattedSubtotal = formatMoney(cfg, line.Subtotal)
+	}
+}
+
+// ギフト注文の領収書を組み立てる（単価・合計などの金額は含めない）
+// 保存済みの注文の場合は呼び出し側で orderMux をロックしていること
+func buildGiftReceipt(order *Order) GiftReceipt {
+	receipt := GiftReceipt{
+		OrderID:       order.ID,
+		Status:        order.Status,
+		CreatedAt:     order.CreatedAt,
+		IsGift:        true,
+		GiftRecipient: order.GiftRecipient,
+		GiftMessage:   order.GiftMessage,
+		LineItems:     []GiftReceiptLine{},
+	}
+	for _, item := range order.Items {
+		receipt.LineItems = append(receipt.LineItems, GiftReceiptLine{
+			ProductID:   item.ProductID,
+			ProductName: item.ProductName,
+			Quantity:    item.Quantity,
+		})
+	}
+	return receipt
+}
+
+// 注文の領収書を組み立てる
+// 保存済みの注文の場合は呼び出し側で orderMux をロックしていること
+func buildOrderReceipt(order *Order) OrderReceipt {
+	receipt := OrderReceipt{
+		OrderID:        order.ID,
+		Status:         order.Status,
+		TransactionID:  order.TransactionID,
+		CreatedAt:      order.CreatedAt,
+		LineItems:      []ReceiptLineItem{},
+		RankDiscount:   order.RankDiscount,
+		Tax:            order.Tax,
+		ShippingFee:    order.ShippingFee,
+		CouponCode:     order.AppliedCoupon,
+		CouponDiscount: order.DiscountAmount,
+		PointsUsed:     order.UsedPoints,
+		PointsDiscount: order.PointsDiscount,
+		PointsEarned:   order.EarnedPoints,
+		TotalPrice:     order.TotalPrice,
+	}
+
+	productMux.RLock()
+	defer productMux.RUnlock()
+
+	for _, item := range order.Items {
+		line := ReceiptLineItem{
+			ProductID:   item.ProductID,
+			ProductName: item.ProductName,
+			UnitPrice:   item.UnitPrice,
+			Quantity:    item.Quantity,
+
+			SaleDiscount: item.SaleDiscount,
+		}
+		// 記録がない古い注文のみ現在の商品情報で補完
+		if product, exists := products[item.ProductID]; exists {
+			if line.ProductName == "" {
+				line.ProductName = product.Name
+			}
+			// 購入金額特典のプレゼントは単価0が正しい記録
+			if line.UnitPrice == 0 && !item.IsGift {
+				line.UnitPrice = product.Price
+			}
+		}
+		line.Subtotal = line.UnitPrice*line.Quantity - line.SaleDiscount
+		receipt.ItemsSubtotal += line.Subtotal
+		receipt.LineItems = append(receipt.LineItems, line)
+	}
+
+	return receipt
+}
+
+// 注文の領収書取得（注文者本人または管理者）
+func getOrderReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// URLから注文IDを取得（/orders/{id}/receipt）
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 || parts[3] != "receipt" {
+		errorResponse(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	orderID, err := strconv.Atoi(parts[2])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	// 再試行・返金・キャンセル・出荷が注文を変更するため、領収書はロックの中で組み立てる
+	orderMux.RLock()
+	order := orders[orderID]
+	// 他人の注文は存在を明かさない
+	if order == nil || (order.UserID != user.ID && !user.IsAdmin) {
+		orderMux.RUnlock()
+		errorResponse(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	// ギフト注文は金額を伏せた領収書を返す（?format は指定されても無視する）
+	if order.IsGift {
+		giftReceipt := buildGiftReceipt(order)
+		orderMux.RUnlock()
+		jsonResponse(w, http.StatusOK, giftReceipt)
+		return
+	}
+
+	receipt := buildOrderReceipt(order)
+	orderMux.RUnlock()
+
+	// 表示用の金額文字列（?format=money）
+	switch r.URL.Query().Get("format") {
+	case "":
+	case "money":
+		addFormattedAmounts(currentConfig(), &receipt)
+	default:
+		errorResponse(w, http.StatusBadRequest, "Invalid format (must be money)")
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, receipt)
+}
+
+// 注文ステータスの変更履歴（注文者本人または管理者）
+func getOrderHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// URLから注文IDを取得（/orders/{id}/history）
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 || parts[3] != "history" {
+		errorResponse(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	orderID, err := strconv.Atoi(parts[2])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	orderMux.RLock()
+	order := orders[orderID]
+	// 他人の注文は存在を明かさない
+	if order == nil || (order.UserID != user.ID && !user.IsAdmin) {
+		orderMux.RUnlock()
+		errorResponse(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	response := OrderStatusHistoryResponse{
+		OrderID: order.ID,
+		Status:  order.Status,
+		History: append([]OrderStatusChange{}, order.StatusHistory...),
+	}
+	orderMux.RUnlock()
+
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// 販売分析レポート取得（管理者のみ）
+func getSalesReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	// 倉庫別在庫の並び順（デフォルトは倉庫名順）
+	warehouseSort := r.URL.Query().Get("warehouse_sort")
+	if warehouseSort == "" {
+		warehouseSort = "name"
+	}
+	if !validWarehouseSorts[warehouseSort] {
+		errorResponse(w, http.StatusBadRequest, "Invalid warehouse_sort (must be stock_desc, stock_asc or name)")
+		return
+	}
+
+	// レポート生成
+	report := generateSalesReport()
+	sortWarehouseInventory(report.WarehouseInventory, warehouseSort)
+	jsonResponse(w, http.StatusOK, report)
+}
+
+// 売上として数える注文か（決済完了後に出荷済み・一部返金になった注文を含む。全額返金した注文は含まない）
+func isCompletedSale(order *Order) bool {
+	return order.Status == "completed" || order.Status == "shipped" || order.Status == "partially_refunded"
+}
+
+// 出荷待ちの注文か（決済完了後に未出荷のもの。一部返金された未出荷の注文は残りの明細を出荷する）
+// 出荷済みかどうかは返金の状態とは別に ShippedAt で判定する
+func isAwaitingShipment(order *Order) bool {
+	return order.Status == "completed" || (order.Status == "partially_refunded" && order.ShippedAt == nil)
+}
+
+// 完了した注文の商品ごとの販売数量（購入金額特典のプレゼントは含めない）
+func completedOrderQuantities() map[int]int {
+	orderMux.RLock()
+	defer orderMux.RUnlock()
+
+	quantities := make(map[int]int) // productID -> total quantity
+	for _, order := range orders {
+		if !isCompletedSale(order) {
+			continue
+		}
+		for _, item := range order.Items {
+			if item.IsGift {
+				continue
+			}
+			quantities[item.ProductID] += item.Quantity
+		}
+	}
+	return quantities
+}
+
+// 日別売上レポートの期間の上限（日数）と、from 省略時の日数
+const (
+	maxRevenueReportDays     = 366
+	defaultRevenueReportDays = 30
+)
+
+// 日別レポートで集計する日付（YYYY-MM-DD、ローカル時刻の日単位、昇順）
+// to 省略時は今日、from 省略時は to までの30日間。期間が上限を超える場合はエラー
+func reportDates(from, to time.Time) ([]string, error) {
+	startOfDay := func(t time.Time) time.Time {
+		t = t.In(time.Local)
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	lastDay := startOfDay(to)
+	firstDay := lastDay.AddDate(0, 0, -(defaultRevenueReportDays - 1))
+	if !from.IsZero() {
+		firstDay = startOfDay(from)
+	}
+	if firstDay.AddDate(0, 0, maxRevenueReportDays).Before(lastDay.AddDate(0, 0, 1)) {
+		return nil, fmt.Errorf("Date range too large (max %d days)", maxRevenueReportDays)
+	}
+
+	dates := []string{}
+	for day := firstDay; !day.After(lastDay); day = day.AddDate(0, 0, 1) {
+		dates = append(dates, day.Format("2006-01-02"))
+	}
+	return dates, nil
+}
+
+// 日別売上レポート（管理者のみ）
+// 期間内の完了注文を日ごとに集計し、売上のない日も 0 で含める
+func getDailyRevenueReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	from, to, err := parseDateRangeParams(r)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dates, err := reportDates(from, to)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result := make([]DailyRevenue, len(dates))
+	index := make(map[string]int) // date -> result のインデックス
+	for i, date := range dates {
+		index[date] = i
+		result[i] = DailyRevenue{Date: date}
+	}
+
+	orderMux.RLock()
+	for _, order := range orders {
+		if !isCompletedSale(order) || !inDateRange(order.CreatedAt, from, to) {
+			continue
+		}
+		i, ok := index[order.CreatedAt.In(time.Local).Format("2006-01-02")]
+		if !ok {
+			continue
+		}
+		result[i].Revenue += order.TotalPrice
+		result[i].OrderCount++
+	}
+	orderMux.RUnlock()
+
+	jsonResponse(w, http.StatusOK, result)
+}
+
+// 商品の日別販売数（管理者のみ）
+// 期間内の完了注文（出荷済み・一部返金を含む）の販売数量を日ごとに集計し、販売のない日も 0 で含める
+// 購入金額特典のプレゼント明細は販売数に含めない
+func getProductDailySalesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	// URLから商品IDを取得（/admin/products/{id}/sales）
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 5 || parts[4] != "sales" {
+		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+	productID, err := strconv.Atoi(parts[3])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	productMux.RLock()
+	product := products[productID]
+	productMux.RUnlock()
+	if product == nil {
+		errorResponse(w, http.StatusNotFound, "Product not found")
+		return
+	}
+
+	from, to, err := parseDateRangeParams(r)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	dates, err := reportDates(from, to)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	response := ProductDailySalesResponse{
+		ProductID: product.ID,
+		Name:      product.Name,
+		Days:      make([]DailyProductSales, len(dates)),
+	}
+	index := make(map[string]int) // date -> Days のインデックス
+	for i, date := range dates {
+		index[date] = i
+		response.Days[i] = DailyProductSales{Date: date}
+	}
+
+	orderMux.RLock()
+	for _, order := range orders {
+		if !isCompletedSale(order) || !inDateRange(order.CreatedAt, from, to) {
+			continue
+		}
+		i, ok := index[order.CreatedAt.In(time.Local).Format("2006-01-02")]
+		if !ok {
+			continue
+		}
+		for _, item := range order.Items {
+			if item.ProductID == productID && !item.IsGift {
+				response.Days[i].Quantity += item.Quantity
+			}
+		}
+	}
+	orderMux.RUnlock()
+
+	for _, day := range response.Days {
+		response.TotalQuantity += day.Quantity
+	}
+
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// 一度も販売されていない商品一覧（管理者のみ、在庫の多い順）
+func getNeverSoldReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	sold := completedOrderQuantities()
+
+	result := []NeverSoldProduct{}
+	productMux.RLock()
+	for _, p := range products {
+		if sold[p.ID] > 0 {
+			continue
+		}
+		totalStock, _ := getProductStock(p.ID)
+		result = append(result, NeverSoldProduct{
+			ProductID:  p.ID,
+			Name:       p.Name,
+			Category:   p.Category,
+			Price:      p.Price,
+			TotalStock: totalStock,
+		})
+	}
+	productMux.RUnlock()
+
+	// 在庫の多い順（同数は商品ID順）
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].TotalStock != result[j].TotalStock {
+			return result[i].TotalStock > result[j].TotalStock
+		}
+		return result[i].ProductID < result[j].ProductID
+	})
+
+	jsonResponse(w, http.StatusOK, result)
+}
+
+// クーポン別の割引実績レポート（管理者のみ）
+// 完了注文（出荷済みを含む）の割引額をクーポンごとに合計し、割引額の多い順に返す
+func getCouponImpactReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	impacts := make(map[string]*CouponImpact)
+	orderMux.RLock()
+	for _, order := range orders {
+		if !isCompletedSale(order) || order.AppliedCoupon == "" {
+			continue
+		}
+		impact := impacts[order.AppliedCoupon]
+		if impact == nil {
+			impact = &CouponImpact{Code: order.AppliedCoupon}
+			impacts[order.AppliedCoupon] = impact
+		}
+		impact.TotalDiscount += order.DiscountAmount
+		impact.UsageCount++
+	}
+	orderMux.RUnlock()
+
+	result := make([]CouponImpact, 0, len(impacts))
+	for _, impact := range impacts {
+		result = append(result, *impact)
+	}
+
+	// 割引額の多い順（同額はコード順）
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].TotalDiscount != result[j].TotalDiscount {
+			return result[i].TotalDiscount > result[j].TotalDiscount
+		}
+		return result[i].Code < result[j].Code
+	})
+
+	jsonResponse(w, http.StatusOK, result)
+}
+
+// 会員ランク別の人数レポート（管理者のみ）
+// 区分の下位から順に全ランクを返し（0人のランクも含む）、区分にないランクのユーザーがいれば名前順に後ろへ追加する
+func getRankDistributionReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	counts := make(map[string]int)
+	userMux.RLock()
+	for _, u := range users {
+		counts[u.MemberRank]++
+	}
+	userMux.RUnlock()
+
+	result := []RankDistribution{}
+	for _, tier := range rankTiers {
+		result = append(result, RankDistribution{Rank: tier.Name, MinSpent: tier.MinSpent, UserCount: counts[tier.Name]})
+		delete(counts, tier.Name)
+	}
+	var others []string
+	for rank := range counts {
+		others = append(others, rank)
+	}
+	sort.Strings(others)
+	for _, rank := range others {
+		result = append(result, RankDistribution{Rank: rank, UserCount: counts[rank]})
+	}
+
+	jsonResponse(w, http.StatusOK, result)
+}
+
+// 実行時に有効な設定の取得（管理者のみ）
+// 環境変数から読み込んだ設定と価格計算の料率を返す。決済ゲートウェイの認証情報などの秘密情報は含めない
+func getConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, buildAdminConfigResponse(currentConfig()))
+}
+
+// 実行時設定の更新（管理者のみ）
+// 指定した項目だけを変更する。すべての値を検証してから一度に反映するため、
+// 途中の値で価格計算が行われることはない（1つでも不正な値があれば何も変更しない）
+func updateConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PATCH" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	var req UpdateConfigRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	configMux.Lock()
+	cfg := appConfig
+	if err := applyConfigUpdate(&cfg, req); err != nil {
+		configMux.Unlock()
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	appConfig = cfg
+	configMux.Unlock()
+
+	log.Printf("Config updated by %s", user.Username)
+	jsonResponse(w, http.StatusOK, buildAdminConfigResponse(cfg))
+}
+
+// 管理者向けの設定レスポンスを作成する（期間は文字列表記）
+func buildAdminConfigResponse(cfg Config) AdminConfigResponse {
+	return AdminConfigResponse{
+		TaxRatePercent:        cfg.TaxRatePercent,
+		PointsRatePercent:     cfg.PointsRatePercent,
+		FreeShippingThreshold: cfg.FreeShippingThreshold,
+		StandardShippingFee:   cfg.StandardShippingFee,
+
+		PointsRedemptionRate: cfg.PointsRedemptionRate,
+
+		PaymentTimeout:                 cfg.PaymentTimeout.String(),
+		DefaultWarehouseID:             cfg.DefaultWarehouseID,
+		MaxWishlistSize:                cfg.MaxWishlistSize,
+		MaxOrderItems:                  cfg.MaxOrderItems,
+		SafetyStock:                    cfg.SafetyStock,
+		PointsExclusionDiscountPercent: cfg.PointsExclusionDiscountPercent,
+		AuthHeader:                     cfg.AuthHeader,
+		AllocationStrategy:             cfg.AllocationStrategy,
+		PointsRounding:                 cfg.PointsRounding,
+		DuplicateOrderWindow:           cfg.DuplicateOrderWindow.String(),
+		LowStockThreshold:              cfg.LowStockThreshold,
+		Currency:                       cfg.Currency,
+		MoneyLocale:                    cfg.MoneyLocale,
+		CurrencyMinorUnits:             cfg.CurrencyMinorUnits,
+		AllocationFloor:                cfg.AllocationFloor,
+		MaxDiscountPercent:             cfg.MaxDiscountPercent,
+		CancellationWindow:             cfg.CancellationWindow.String(),
+		FailedOrderRetention:           cfg.FailedOrderRetention.String(),
+		FailedOrderSweepInterval:       cfg.FailedOrderSweepInterval.String(),
+		FraudHighQuantity:              cfg.FraudHighQuantity,
+		FraudLargePointsRedemption:     cfg.FraudLargePointsRedemption,
+		FraudNewAccountAge:             cfg.FraudNewAccountAge.String(),
+		FraudNewAccountOrderAmount:     cfg.FraudNewAccountOrderAmount,
+		RegisterCheckRateLimit:         cfg.RegisterCheckRateLimit,
+		RegisterCheckRateWindow:        cfg.RegisterCheckRateWindow.String(),
+		StaleOrderTimeout:              cfg.StaleOrderTimeout.String(),
+		StaleOrderSweepInterval:        cfg.StaleOrderSweepInterval.String(),
+		RecommendWeightWishlist:        cfg.RecommendWeightWishlist,
+		RecommendWeightPurchase:        cfg.RecommendWeightPurchase,
+		RecommendWeightView:            cfg.RecommendWeightView,
+		RecommendWeightPopularity:      cfg.RecommendWeightPopularity,
+		RecommendationLimit:            cfg.RecommendationLimit,
+	}
+}
+
+// 更新内容を検証して cfg（呼び出し側のコピー）に反映する
+func applyConfigUpdate(cfg *Config, req UpdateConfigRequest) error {
+	percentFields := []struct {
+		name  string
+		value *int
+		dst   *int
+	}{
+		{"tax_rate_percent", req.TaxRatePercent, &cfg.TaxRatePercent},
+		{"points_rate_percent", req.PointsRatePercent, &cfg.PointsRatePercent},
+		{"max_discount_percent", req.MaxDiscountPercent, &cfg.MaxDiscountPercent},
+		{"points_exclusion_discount_percent", req.PointsExclusionDiscountPercent, &cfg.PointsExclusionDiscountPercent},
+	}
+	amountFields := []struct {
+		name  string
+		value *int
+		dst   *int
+		min   int
+	}{
+		{"free_shipping_threshold", req.FreeShippingThreshold, &cfg.FreeShippingThreshold, 0},
+		{"standard_shipping_fee", req.StandardShippingFee, &cfg.StandardShippingFee, 0},
+		{"max_order_items", req.MaxOrderItems, &cfg.MaxOrderItems, 1},
+		{"max_wishlist_size", req.MaxWishlistSize, &cfg.MaxWishlistSize, 1},
+		{"low_stock_threshold", req.LowStockThreshold, &cfg.LowStockThreshold, 0},
+	}
+
+	updated := false
+	for _, f := range percentFields {
+		if f.value == nil {
+			continue
+		}
+		if *f.value < 0 || *f.value > 100 {
+			return fmt.Errorf("%s must be between 0 and 100", f.name)
+		}
+		*f.dst = *f.value
+		updated = true
+	}
+	for _, f := range amountFields {
+		if f.value == nil {
+			continue
+		}
+		if *f.value < f.min {
+			return fmt.Errorf("%s must be at least %d", f.name, f.min)
+		}
+		*f.dst = *f.value
+		updated = true
+	}
+	if req.AllocationStrategy != nil {
+		if *req.AllocationStrategy != allocationSplit && *req.AllocationStrategy != allocationNoSplit {
+			return fmt.Errorf("allocation_strategy must be %q or %q", allocationSplit, allocationNoSplit)
+		}
+		cfg.AllocationStrategy = *req.AllocationStrategy
+		updated = true
+	}
+	if req.PointsRounding != nil {
+		switch *req.PointsRounding {
+		case pointsRoundingFloor, pointsRoundingRound, pointsRoundingCeil:
+		default:
+			return fmt.Errorf("points_rounding must be %q, %q or %q", pointsRoundingFloor, pointsRoundingRound, pointsRoundingCeil)
+		}
+		cfg.PointsRounding = *req.PointsRounding
+		updated = true
+	}
+	if req.PointsRedemptionRate != nil {
+		if *req.PointsRedemptionRate <= 0 || math.IsInf(*req.PointsRedemptionRate, 0) {
+			return errors.New("points_redemption_rate must be greater than 0")
+		}
+		cfg.PointsRedemptionRate = *req.PointsRedemptionRate
+		updated = true
+	}
+	if !updated {
+		return errors.New("No configurable fields provided")
+	}
+	return nil
+}
+
+// 有効なセッション一覧（管理者のみ）
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	// ユーザーIDフィルタ
+	filterUserID := 0
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			errorResponse(w, http.StatusBadRequest, "Invalid user_id")
+			return
+		}
+		filterUserID = id
+	}
+
+	result := []SessionInfo{}
+	sessionMux.RLock()
+	for token, sessionUser := range sessions {
+		if sessionUser == nil {
+			continue
+		}
+		if filterUserID != 0 && sessionUser.ID != filterUserID {
+			continue
+		}
+		info := SessionInfo{
+			UserID:      sessionUser.ID,
+			Username:    sessionUser.Username,
+			TokenPrefix: maskToken(token),
+		}
+		if createdAt, ok := sessionCreatedAt[token]; ok {
+			t := createdAt
+			info.CreatedAt = &t
+		}
+		result = append(result, info)
+	}
+	sessionMux.RUnlock()
+
+	// ユーザーID順、同一ユーザー内はトークン接頭辞順（安定した出力のため）
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].UserID != result[j].UserID {
+			return result[i].UserID < result[j].UserID
+		}
+		return result[i].TokenPrefix < result[j].TokenPrefix
+	})
+
+	jsonResponse(w, http.StatusOK, result)
+}
+
+// ユーザーの全セッションを強制ログアウト（管理者のみ）
+func logoutAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	// URLからユーザーIDを取得 (/admin/users/{id}/logout-all)
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 5 || parts[4] != "logout-all" {
+		errorResponse(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	targetUserID, err := strconv.Atoi(parts[3])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	userMux.RLock()
+	_, exists := users[targetUserID]
+	userMux.RUnlock()
+	if !exists {
+		errorResponse(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	// 対象ユーザーのセッションをすべて削除
+	revoked := 0
+	sessionMux.Lock()
+	for token, sessionUser := range sessions {
+		if sessionUser != nil && sessionUser.ID == targetUserID {
+			delete(sessions, token)
+			delete(sessionCreatedAt, token)
+			revoked++
+		}
+	}
+	sessionMux.Unlock()
+
+	jsonResponse(w, http.StatusOK, map[string]int{
+		"user_id": targetUserID,
+		"revoked": revoked,
+	})
+}
+
+// クエリパラメータ from / to を期間として解釈する
+// 日付のみ（2006-01-02）または RFC3339 形式を受け付け、日付のみの to はその日の終わりまでを含む
+// 指定がない側はゼロ値を返す
+func parseDateRangeParams(r *http.Request) (from, to time.Time, err error) {
+	parse := func(name string, endOfDay bool) (time.Time, error) {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			return time.Time{}, nil
+		}
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t, nil
+		}
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid %s (use YYYY-MM-DD or RFC3339)", name)
+		}
+		if endOfDay {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return t, nil
+	}
+
+	if from, err = parse("from", false); err != nil {
+		return
+	}
+	if to, err = parse("to", true); err != nil {
+		return
+	}
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		err = errors.New("from must not be after to")
+	}
+	return
+}
+
+// 期間内かどうか（ゼロ値の端は制限なし）
+func inDateRange(t, from, to time.Time) bool {
+	if !from.IsZero() && t.Before(from) {
+		return false
+	}
+	if !to.IsZero() && t.After(to) {
+		return false
+	}
+	return true
+}
+
+// クーポン利用注文一覧（管理者のみ）
+func getCouponOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	// URLからクーポンコードを取得 (/admin/coupons/{code}/orders)
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 5 || parts[3] == "" || parts[4] != "orders" {
+		errorResponse(w, http.StatusBadRequest, "Invalid coupon code")
+		return
+	}
+	code := parts[3]
+
+	from, to, err := parseDateRangeParams(r)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	couponMux.RLock()
+	_, exists := coupons[code]
+	couponMux.RUnlock()
+	if !exists {
+		errorResponse(w, http.StatusNotFound, "Coupon not found")
+		return
+	}
+
+	response := CouponOrdersResponse{
+		CouponCode: code,
+		Orders:     []*Order{},
+	}
+	orderMux.RLock()
+	for _, order := range orders {
+		if order.AppliedCoupon != code || !inDateRange(order.CreatedAt, from, to) {
+			continue
+		}
+		response.Orders = append(response.Orders, order)
+		response.TotalOrders++
+		switch {
+		case isCompletedSale(order):
+			response.CompletedOrders++
+			response.TotalRevenue += order.TotalPrice
+			response.TotalDiscount += order.DiscountAmount
+		case order.Status == "payment_failed":
+			response.FailedOrders++
+		}
+	}
+	orderMux.RUnlock()
+
+	// 注文ID順（安定した出力のため）
+	sort.Slice(response.Orders, func(i, j int) bool {
+		return response.Orders[i].ID < response.Orders[j].ID
+	})
+
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// 全商品の倉庫別在庫一覧（管理者のみ、参照専用）
+func getInventoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	category := r.URL.Query().Get("category")
+	sortOrder := r.URL.Query().Get("sort")
+	if sortOrder != "" && sortOrder != "total_asc" && sortOrder != "id" {
+		errorResponse(w, http.StatusBadRequest, "Invalid sort (must be total_asc or id)")
+		return
+	}
+
+	// 倉庫一覧（ID順）
+	warehouseMux.RLock()
+	warehouseList := make([]*Warehouse, 0, len(warehouses))
+	for _, warehouse := range warehouses {
+		warehouseList = append(warehouseList, warehouse)
+	}
+	warehouseMux.RUnlock()
+	sort.Slice(warehouseList, func(i, j int) bool {
+		return warehouseList[i].ID < warehouseList[j].ID
+	})
+
+	cfg := currentConfig()
+	productMux.RLock()
+	result := []InventoryItem{}
+	for _, p := range products {
+		if category != "" && p.Category != category {
+			continue
+		}
+		result = append(result, InventoryItem{
+			ProductID: p.ID,
+			Name:      p.Name,
+			Category:  p.Category,
+
+			SafetyStock: safetyStockFor(cfg, p),
+		})
+	}
+	productMux.RUnlock()
+
+	stockMux.RLock()
+	for i := range result {
+		item := &result[i]
+		item.Warehouses = make([]InventoryWarehouseQty, 0, len(warehouseList))
+		for _, warehouse := range warehouseList {
+			quantity := 0
+			if stock, exists := stocks[fmt.Sprintf("%d-%d", item.ProductID, warehouse.ID)]; exists {
+				quantity = stock.Quantity
+			}
+			item.Warehouses = append(item.Warehouses, InventoryWarehouseQty{
+				WarehouseID:   warehouse.ID,
+				WarehouseName: warehouse.Name,
+				Quantity:      quantity,
+			})
+			item.TotalStock += quantity
+		}
+		item.AvailableStock = item.TotalStock - item.SafetyStock
+		if item.AvailableStock < 0 {
+			item.AvailableStock = 0
+		}
+	}
+	stockMux.RUnlock()
+
+	// 並び順（デフォルトは商品ID順、total_asc は在庫の少ない順）
+	sort.Slice(result, func(i, j int) bool {
+		if sortOrder == "total_asc" && result[i].TotalStock != result[j].TotalStock {
+			return result[i].TotalStock < result[j].TotalStock
+		}
+		return result[i].ProductID < result[j].ProductID
+	})
+
+	jsonResponse(w, http.StatusOK, result)
+}
+
+// 倉庫別在庫の並び順として指定可能な値
+var validWarehouseSorts = map[string]bool{
+	"name":       true,
+	"stock_desc": true,
+	"stock_asc":  true,
+}
+
+// 倉庫別在庫を指定の順序で並び替える（在庫数が同じ場合は倉庫名順）
+func sortWarehouseInventory(inventory []WarehouseInventoryStat, order string) {
+	sort.SliceStable(inventory, func(i, j int) bool {
+		a, b := inventory[i], inventory[j]
+		switch order {
+		case "stock_desc":
+			if a.TotalStock != b.TotalStock {
+				return a.TotalStock > b.TotalStock
+			}
+		case "stock_asc":
+			if a.TotalStock != b.TotalStock {
+				return a.TotalStock < b.TotalStock
+			}
+		}
+		return a.WarehouseName < b.WarehouseName
+	})
+}
+
+// トランザクションIDによる注文検索（管理者のみ）
+func getOrderByTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	// URLからトランザクションIDを取得
+	transactionID := strings.TrimPrefix(r.URL.Path, "/admin/orders/by-transaction/")
+	if transactionID == "" || strings.Contains(transactionID, "/") {
+		errorResponse(w, http.StatusBadRequest, "Invalid transaction ID")
+		return
+	}
+
+	orderMux.RLock()
+	defer orderMux.RUnlock()
+
+	orderID, exists := ordersByTransaction[transactionID]
+	if !exists || orders[orderID] == nil {
+		errorResponse(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, buildAdminOrderResponse(orders[orderID]))
+}
+
+// 決済失敗注文の決済再試行（管理者のみ）
+// 在庫を再確認して決済をやり直し、成功した場合は在庫引当・ポイント付与を行って完了にする
+func retryOrderPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	// URLから注文IDを取得（/admin/orders/{id}/retry-payment）
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 5 || parts[4] != "retry-payment" {
+		errorResponse(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+	orderID, err := strconv.Atoi(parts[3])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	// 処理中の状態に切り替えてから再試行する（同じ注文の二重処理を防ぐ）
+	orderMux.Lock()
+	order := orders[orderID]
+	if order == nil {
+		orderMux.Unlock()
+		errorResponse(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if order.Status != "payment_failed" {
+		orderMux.Unlock()
+		errorResponse(w, http.StatusConflict, fmt.Sprintf("Only payment_failed orders can be retried (status: %s)", order.Status))
+		return
+	}
+	setOrderStatus(order, "payment_processing", user.ID)
+	orderMux.Unlock()
+
+	// 失敗時は決済失敗の状態に戻し、この再試行で使用したポイントを戻す
+	// （処理が長引いて cleanupStaleOrders にキャンセルされていた場合は状態を変えない。ポイントの返却は二重にならない）
+	markFailed := func() {
+		orderMux.Lock()
+		if order.Status == "payment_processing" {
+			setOrderStatus(order, "payment_failed", user.ID)
+		}
+		orderMux.Unlock()
+		returnHeldPoints(order.UserID, order.ID)
+	}
+
+	// この再試行の処理中は同じ設定を使う
+	cfg := currentConfig()
+
+	// 在庫の再確認
+	for _, availability := range checkStockAvailability(cfg, order.Items) {
+		if !availability.Sufficient {
+			markFailed()
+			errorResponse(w, http.StatusConflict,
+				fmt.Sprintf("Insufficient stock for product %d (available: %d, requested: %d)",
+					availability.ProductID, availability.Available, availability.Requested))
+			return
+		}
+	}
+
+	// 失敗時にロールバックしたポイントを再度使用する
+	if order.UsedPoints > 0 && !usePoints(order.UserID, order.ID, order.UsedPoints) {
+		markFailed()
+		errorResponse(w, http.StatusConflict, "Insufficient points to retry this order")
+		return
+	}
+
+	var paymentResult PaymentResult
+	var paymentErr error
+	if order.TotalPrice == 0 {
+		paymentResult = PaymentResult{Success: true, Message: "No payment required"}
+	} else {
+		paymentResult, paymentErr = processPaymentWithTimeout(r.Context(), cfg.PaymentTimeout, order.TotalPrice, order.ID)
+	}
+
+	if paymentErr != nil || !paymentResult.Success {
+		markFailed()
+		switch {
+		case errors.Is(paymentErr, context.DeadlineExceeded):
+			errorResponse(w, http.StatusGatewayTimeout, "Payment timed out")
+		case paymentErr != nil:
+			errorResponse(w, http.StatusServiceUnavailable, "Payment cancelled")
+		default:
+			errorResponse(w, http.StatusPaymentRequired, fmt.Sprintf("Payment failed: %s", paymentResult.Message))
+		}
+		return
+	}
+
+	stockAllocations, allAllocated := allocateOrderStock(cfg, order.Items, order.Destination)
+	if !allAllocated {
+		markFailed()
+		errorResponse(w, http.StatusConflict, "Stock allocation failed. Please retry.")
+		return
+	}
+
+	orderMux.Lock()
+	if order.Status != "payment_processing" {
+		// 処理中に放置注文としてキャンセルされた。決済は成立しているため、返金できるように
+		// トランザクションIDを注文に記録して返金が必要なことを示すフラグを付ける
+		status := order.Status
+		order.TransactionID = paymentResult.TransactionID
+		if order.TransactionID != "" {
+			ordersByTransaction[order.TransactionID] = order.ID
+		}
+		if paymentResult.TransactionID != "" || order.TotalPrice > 0 {
+			order.OrderFlags = append(order.OrderFlags, orderFlagRefundRequired)
+		}
+		orderMux.Unlock()
+		log.Printf("Order %d was %s while its payment was processing; transaction %q (amount %d) must be refunded",
+			order.ID, status, paymentResult.TransactionID, order.TotalPrice)
+		releaseStock(stockAllocations)
+		returnHeldPoints(order.UserID, order.ID)
+		errorResponse(w, http.StatusConflict, fmt.Sprintf("Order was cancelled while processing (status: %s)", status))
+		return
+	}
+	setOrderStatus(order, "completed", user.ID)
+	order.TransactionID = paymentResult.TransactionID
+	order.Allocations = stockAllocations
+	if order.TransactionID != "" {
+		ordersByTransaction[order.TransactionID] = order.ID
+	}
+	orderMux.Unlock()
+
+	// ポイント付与と累計購入金額・ランクの更新
+	applyOrderCompletion(order)
+
+	jsonResponse(w, http.StatusOK, buildAdminOrderResponse(order))
+}
+
+// 注文の一括出荷（管理者のみ）
+// 出荷待ち（completed、または未出荷で一部返金）の注文を追跡番号付きで shipped にし、対象外の注文はスキップする
+func bulkShipOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	var req struct {
+		Orders []struct {
+			OrderID        int    `json:"order_id"`
+			Carrier        string `json:"carrier"`
+			TrackingNumber string `json:"tracking_number"`
+		} `json:"orders"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Orders) == 0 {
+		errorResponse(w, http.StatusBadRequest, "No orders to ship")
+		return
+	}
+
+	response := BulkShipResponse{Results: []ShipOrderResult{}}
+	now := time.Now()
+
+	// 一括で状態を確定させるため、全件を同じロックの中で処理する
+	orderMux.Lock()
+	for _, item := range req.Orders {
+		result := ShipOrderResult{OrderID: item.OrderID, Status: "skipped"}
+		order := orders[item.OrderID]
+		switch {
+		case item.Carrier == "" || item.TrackingNumber == "":
+			result.Error = "carrier and tracking_number are required"
+		case order == nil:
+			result.Error = "Order not found"
+		case !isAwaitingShipment(order):
+			result.Error = fmt.Sprintf("Order is not ready to ship (status: %s)", order.Status)
+		default:
+			setOrderStatus(order, "shipped", user.ID)
+			order.Carrier = item.Carrier
+			order.TrackingNumber = item.TrackingNumber
+			shippedAt := now
+			order.ShippedAt = &shippedAt
+			result.Status = "shipped"
+		}
+
+		if result.Status == "shipped" {
+			response.Shipped++
+		} else {
+			response.Skipped++
+		}
+		response.Results = append(response.Results, result)
+	}
+	orderMux.Unlock()
+
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// 出荷待ちの注文一覧（管理者のみ）
+// 返金済みの数量を除いた注文明細（全数量を返金した明細は含めない）
+// 呼び出し側で orderMux を保持していること
+func unrefundedItems(order *Order) []OrderItem {
+	refunded := make(map[int]int)
+	for _, refund := range order.Refunds {
+		for _, line := range refund.Items {
+			refunded[line.ProductID] += line.Quantity
+		}
+	}
+	items := []OrderItem{}
+	for _, item := range order.Items {
+		take := refunded[item.ProductID]
+		if take > item.Quantity {
+			take = item.Quantity
+		}
+		refunded[item.ProductID] -= take
+		item.Quantity -= take
+		if item.Quantity > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// 決済・引当が完了して未出荷（completed、または未出荷で一部返金）の注文を古い順に返す。
+// 返金済みの数量を除いた明細と倉庫ごとの引当数を含む
+func getOrdersToFulfillHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	result := []FulfillmentOrder{}
+	orderMux.RLock()
+	for _, order := range orders {
+		if !isAwaitingShipment(order) {
+			continue
+		}
+		entry := FulfillmentOrder{
+			OrderID:       order.ID,
+			UserID:        order.UserID,
+			CreatedAt:     order.CreatedAt,
+			Items:         unrefundedItems(order),
+			Picks:         []FulfillmentPick{},
+			Destination:   order.Destination,
+			IsGift:        order.IsGift,
+			GiftRecipient: order.GiftRecipient,
+		}
+		for productID, byWarehouse := range order.Allocations {
+			for warehouseID, quantity := range byWarehouse {
+				if quantity > 0 {
+					entry.Picks = append(entry.Picks, FulfillmentPick{WarehouseID: warehouseID, ProductID: productID, Quantity: quantity})
+				}
+			}
+		}
+		result = append(result, entry)
+	}
+	orderMux.RUnlock()
+
+	warehouseMux.RLock()
+	for i := range result {
+		for j := range result[i].Picks {
+			if warehouse := warehouses[result[i].Picks[j].WarehouseID]; warehouse != nil {
+				result[i].Picks[j].WarehouseName = warehouse.Name
+			}
+		}
+	}
+	warehouseMux.RUnlock()
+
+	for _, entry := range result {
+		picks := entry.Picks
+		sort.Slice(picks, func(i, j int) bool {
+			if picks[i].WarehouseID != picks[j].WarehouseID {
+				return picks[i].WarehouseID < picks[j].WarehouseID
+			}
+			return picks[i].ProductID < picks[j].ProductID
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].CreatedAt.Equal(result[j].CreatedAt) {
+			return result[i].CreatedAt.Before(result[j].CreatedAt)
+		}
+		return result[i].OrderID < result[j].OrderID
+	})
+
+	jsonResponse(w, http.StatusOK, result)
+}
+
+// 在庫調整（管理者のみ）
+func adjustStockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	var req struct {
+		ProductID   int    `json:"product_id"`
+		WarehouseID int    `json:"warehouse_id"`
+		Delta       int    `json:"delta"`
+		Reason      string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	// バリデーション
+	if req.Delta == 0 {
+		errorResponse(w, http.StatusBadRequest, "delta must not be zero")
+		return
+	}
+	if !validStockAdjustReasons[req.Reason] {
+		errorResponse(w, http.StatusBadRequest, "Invalid reason")
+		return
+	}
+
+	productMux.RLock()
+	product := products[req.ProductID]
+	productMux.RUnlock()
+	if product == nil {
+		errorResponse(w, http.StatusNotFound, "Product not found")
+		return
+	}
+
+	// 在庫の調整（0未満にはしない）
+	// 倉庫は stockMux の保持中に読む（容量の変更と在庫の増加が入れ違わないように。ロック順は stock → warehouse）
+	stockMux.Lock()
+	warehouseMux.RLock()
+	warehouse := warehouses[req.WarehouseID]
+	warehouseMux.RUnlock()
+	if warehouse == nil {
+		stockMux.Unlock()
+		errorResponse(w, http.StatusNotFound, "Warehouse not found")
+		return
+	}
+
+	key := fmt.Sprintf("%d-%d", req.ProductID, req.WarehouseID)
+	stock := stocks[key]
+	current := 0
+	if stock != nil {
+		current = stock.Quantity
+	}
+
+	newQuantity := current + req.Delta
+	if newQuantity < 0 {
+		stockMux.Unlock()
+		errorResponse(w, http.StatusBadRequest,
+			fmt.Sprintf("Adjustment would make stock negative (current: %d, delta: %d)", current, req.Delta))
+		return
+	}
+
+	// 入荷などで在庫が増える場合は倉庫の容量を超えないこと
+	if req.Delta > 0 {
+		warehouseTotal := warehouseStockTotal(req.WarehouseID)
+		if exceedsWarehouseCapacity(warehouse, warehouseTotal+req.Delta) {
+			stockMux.Unlock()
+			errorResponse(w, http.StatusConflict,
+				fmt.Sprintf("Warehouse capacity exceeded (capacity: %d, current: %d, delta: %d)", warehouse.Capacity, warehouseTotal, req.Delta))
+			return
+		}
+	}
+
+	if stock == nil {
+		stock = &Stock{ProductID: req.ProductID, WarehouseID: req.WarehouseID}
+		stocks[key] = stock
+	}
+	stock.Quantity = newQuantity
+	event := recordStockAuditEvent(req.ProductID, req.WarehouseID, req.Delta, req.Reason, newQuantity, user.ID)
+	stockMux.Unlock()
+
+	jsonResponse(w, http.StatusOK, event)
+}
+
+// 在庫CSVインポート（管理者のみ、棚卸結果で在庫数を上書きする）
+func importStockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	reader := csv.NewReader(r.Body)
+	reader.FieldsPerRecord = -1 // 列数は行ごとに検証する
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid CSV")
+		return
+	}
+
+	// ヘッダーが不正な場合はファイル全体を拒否
+	if len(records) == 0 || len(records[0]) != len(stockImportHeader) {
+		errorResponse(w, http.StatusBadRequest, "Invalid CSV header (expected product_id,warehouse_id,quantity)")
+		return
+	}
+	for i, column := range stockImportHeader {
+		if strings.TrimSpace(records[0][i]) != column {
+			errorResponse(w, http.StatusBadRequest, "Invalid CSV header (expected product_id,warehouse_id,quantity)")
+			return
+		}
+	}
+
+	response := StockImportResponse{Results: []StockImportRowResult{}}
+
+	// ロック順序は product → stock → warehouse
+	productMux.RLock()
+	stockMux.Lock()
+	warehouseMux.RLock()
+	for i, record := range records[1:] {
+		result := StockImportRowResult{Row: i + 2, Status: "error"}
+
+		if len(record) != len(stockImportHeader) {
+			result.Error = "Expected 3 columns"
+			response.Results = append(response.Results, result)
+			response.Failed++
+			continue
+		}
+
+		productID, errProduct := strconv.Atoi(strings.TrimSpace(record[0]))
+		warehouseID, errWarehouse := strconv.Atoi(strings.TrimSpace(record[1]))
+		quantity, errQuantity := strconv.Atoi(strings.TrimSpace(record[2]))
+		result.ProductID = productID
+		result.WarehouseID = warehouseID
+
+		switch {
+		case errProduct != nil:
+			result.Error = "Invalid product_id"
+		case errWarehouse != nil:
+			result.Error = "Invalid warehouse_id"
+		case errQuantity != nil || quantity < 0:
+			result.Error = "Invalid quantity"
+		case products[productID] == nil:
+			result.Error = "Product not found"
+		case warehouses[warehouseID] == nil:
+			result.Error = "Warehouse not found"
+		}
+		if result.Error != "" {
+			response.Results = append(response.Results, result)
+			response.Failed++
+			continue
+		}
+
+		key := fmt.Sprintf("%d-%d", productID, warehouseID)
+		previous := 0
+		if stocks[key] != nil {
+			previous = stocks[key].Quantity
+		}
+
+		// 在庫が増える行は倉庫の容量を超えないこと（それまでの行の反映後の合計で判定）
+		if quantity > previous &&
+			exceedsWarehouseCapacity(warehouses[warehouseID], warehouseStockTotal(warehouseID)-previous+quantity) {
+			result.Error = "Warehouse capacity exceeded"
+			response.Results = append(response.Results, result)
+			response.Failed++
+			continue
+		}
+
+		stock := stocks[key]
+		if stock == nil {
+			stock = &Stock{ProductID: productID, WarehouseID: warehouseID}
+			stocks[key] = stock
+		}
+		result.Previous = previous
+		stock.Quantity = quantity
+		if delta := quantity - result.Previous; delta != 0 {
+			recordStockAuditEvent(productID, warehouseID, delta, "miscount", quantity, user.ID)
+		}
+
+		result.Quantity = quantity
+		result.Status = "updated"
+		response.Results = append(response.Results, result)
+		response.Updated++
+	}
+	warehouseMux.RUnlock()
+	stockMux.Unlock()
+	productMux.RUnlock()
+
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// 倉庫の容量の変更（0は無制限）
+// 現在の在庫合計より小さい容量には変更できない
+func updateWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PATCH" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
+		return
+	}
+
+	// URLから倉庫IDを取得
+	warehouseID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/admin/warehouses/"))
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid warehouse ID")
+		return
+	}
+
+	var req struct {
+		Capacity *int `json:"capacity"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Capacity == nil || *req.Capacity < 0 {
+		errorResponse(w, http.StatusBadRequest, "capacity must be 0 or greater")
+		return
+	}
+
+	// 在庫合計の確認と容量の変更を同じロックの中で行う（ロック順は stock → warehouse）
+	stockMux.Lock()
+	defer stockMux.Unlock()
+	warehouseMux.Lock()
+	defer warehouseMux.Unlock()
+
+	warehouse := warehouses[warehouseID]
+	if warehouse == nil {
+		errorResponse(w, http.StatusNotFound, "Warehouse not found")
+		return
+	}
+	total := warehouseStockTotal(warehouseID)
+	if *req.Capacity > 0 && total > *req.Capacity {
+		errorResponse(w, http.StatusConflict,
+			fmt.Sprintf("Capacity is below current stock (capacity: %d, current: %d)", *req.Capacity, total))
+		return
+	}
+
+	// ロックの外で参照中の倉庫に影響しないよう、変更後の倉庫を新しく作って差し替える
+	updated := *warehouse
+	updated.Capacity = *req.Capacity
+	warehouses[warehouseID] = &updated
+
+	jsonResponse(w, http.StatusOK, updated)
+}
+
+// 倉庫に在庫がある商品一覧
+func getWarehouseProductsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// URLから倉庫IDを取得（/warehouses/{id}/products）
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 || parts[3] != "products" {
+		errorResponse(w, http.StatusBadRequest, "Invalid warehouse ID")
+		return
+	}
+	warehouseID, err := strconv.Atoi(parts[2])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid warehouse ID")
+		return
+	}
+
+	warehouseMux.RLock()
+	_, exists := warehouses[warehouseID]
+	warehouseMux.RUnlock()
+	if !exists {
+		errorResponse(w, http.StatusNotFound, "Warehouse not found")
+		return
+	}
+
+	result := []WarehouseProduct{}
+	productMux.RLock()
+	stockMux.RLock()
+	for _, stock := range stocks {
+		if stock.WarehouseID != warehouseID || stock.Quantity <= 0 {
+			continue
+		}
+		product := products[stock.ProductID]
+		if product == nil {
+			continue
+		}
+		result = append(result, WarehouseProduct{
+			ProductID: product.ID,
+			Name:      product.Name,
+			Category:  product.Category,
+			Price:     product.Price,
+			Quantity:  stock.Quantity,
+		})
+	}
+	stockMux.RUnlock()
+	productMux.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ProductID < result[j].ProductID
+	})
+
+	jsonResponse(w, http.StatusOK, result)
+}
+
+// クーポン詳細取得
+func getCouponHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// URLからクーポンコードを取得
+	code := strings.TrimPrefix(r.URL.Path, "/coupons/")
+	if code == "" || strings.Contains(code, "/") {
+		errorResponse(w, http.StatusBadRequest, "Invalid coupon code")
+		return
+	}
+
+	couponMux.RLock()
+	coupon := coupons[code]
+	couponMux.RUnlock()
+
+	if coupon == nil {
+		errorResponse(w, http.StatusNotFound, "Coupon not found")
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, coupon)
+}
+
+// 一括検証で受け付けるクーポンコードの上限
+const maxCouponValidateCodes = 50
+
+// クーポンの一括検証（保存済みクーポンの利用可否の確認用、クーポンは適用しない）
+// 存在・有効期間・利用回数上限・初回購入限定を判定する。最低注文金額と対象カテゴリは注文内容で決まるため判定しない
+func validateCouponsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req struct {
+		Codes []string `json:"codes"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Codes) == 0 {
+		errorResponse(w, http.StatusBadRequest, "No coupon codes")
+		return
+	}
+	if len(req.Codes) > maxCouponValidateCodes {
+		errorResponse(w, http.StatusBadRequest, "Too many coupon codes")
+		return
+	}
+
+	now := time.Now()
+	results := make([]CouponValidationResult, 0, len(req.Codes))
+	for _, code := range req.Codes {
+		result := CouponValidationResult{Code: code}
+
+		couponMux.RLock()
+		var coupon *Coupon
+		if c := coupons[code]; c != nil {
+			copied := *c
+			coupon = &copied
+		}
+		couponMux.RUnlock()
+
+		if coupon == nil {
+			result.Reason, result.Message = "coupon_not_found", "Coupon not found"
+			results = append(results, result)
+			continue
+		}
+		result.Exists = true
+
+		if coupon.ValidFrom != nil && now.Before(*coupon.ValidFrom) {
+			result.Reason, result.Message = "coupon_not_yet_valid", "Coupon is not yet valid"
+		} else if coupon.ExpiresAt != nil && !now.Before(*coupon.ExpiresAt) {
+			result.Reason, result.Message = "coupon_expired", "Coupon has expired"
+		} else {
+			result.Reason, result.Message = checkCouponEligibility(coupon, user)
+		}
+		result.Valid = result.Reason == ""
+		results = append(results, result)
+	}
+
+	jsonResponse(w, http.StatusOK, results)
+}
+
+// お気に入り追加ハンドラー
+func addToWishlistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// URLから商品IDを取得
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 3 {
+		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	productID, err := strconv.Atoi(parts[2])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	// お気に入りに追加（商品の存在確認も同時に行う）
+	switch err := addToWishlist(user.ID, productID); err {
+	case nil:
+		jsonResponse(w, http.StatusCreated, map[string]interface{}{
+			"message":    "Added to wishlist",
+			"product_id": productID,
+		})
+	case errWishlistProductNotFound:
+		errorResponse(w, http.StatusNotFound, "Product not found")
+	case errWishlistFull:
+		errorResponse(w, http.StatusConflict, "Wishlist full")
+	default:
+		errorResponse(w, http.StatusConflict, "Product already in wishlist")
+	}
+}
+
+// お気に入り削除ハンドラー
+func removeFromWishlistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// URLから商品IDを取得
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 3 {
+		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	productID, err := strconv.Atoi(parts[2])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	// お気に入りから削除
+	if removeFromWishlist(user.ID, productID) {
+		jsonResponse(w, http.StatusOK, map[string]interface{}{
+			"message":    "Removed from wishlist",
+			"product_id": productID,
+		})
+	} else {
+		errorResponse(w, http.StatusNotFound, "Product not in wishlist")
+	}
+}
+
+// お気に入りからの注文見積もりハンドラー（読み取り専用）
+func wishlistCheckoutPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// ユーザーのお気に入り商品IDを取得
+	var productIDs []int
+	wishlistMux.RLock()
+	for _, wishlist := range wishlists {
+		if wishlist != nil && wishlist.UserID == user.ID {
+			productIDs = append(productIDs, wishlist.ProductID)
+		}
+	}
+	wishlistMux.RUnlock()
+	sort.Ints(productIDs)
+
+	// 各商品を数量1で仮注文として組み立て、在庫を一括確認する
+	orderItems := make([]OrderItem, len(productIDs))
+	for i, productID := range productIDs {
+		orderItems[i] = OrderItem{ProductID: productID, Quantity: 1}
+	}
+	cfg := currentConfig()
+	availability := checkStockAvailability(cfg, orderItems)
+	sales := activeCategorySales(time.Now())
+
+	items := []WishlistPreviewItem{}
+	subtotal := 0
+	for _, a := range availability {
+		productMux.RLock()
+		product := products[a.ProductID]
+		productMux.RUnlock()
+
+		if !a.Found || product == nil {
+			continue // 削除済みの商品は対象外
+		}
+
+		item := WishlistPreviewItem{
+			ProductID:      product.ID,
+			Name:           product.Name,
+			Price:          product.Price,
+			Quantity:       a.Requested,
+			AvailableStock: a.Available,
+			InStock:        a.Sufficient,
+		}
+		if item.InStock {
+			subtotal += unitPriceFor(product, item.Quantity)*item.Quantity - saleDiscountFor(cfg, product, item.Quantity, sales)
+		}
+		items = append(items, item)
+	}
+
+	userMux.RLock()
+	rank := user.MemberRank
+	userMux.RUnlock()
+
+	response := WishlistCheckoutPreviewResponse{Items: items}
+	// 購入できる商品がない場合は送料だけの見積もりにしない
+	if subtotal > 0 {
+		response.Estimate = calculateOrderTotals(cfg, subtotal, rank, nil, 0)
+	}
+
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// お気に入り商品の合計金額（現在価格の合計と在庫状況）
+func getWishlistValueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var productIDs []int
+	wishlistMux.RLock()
+	for _, wishlist := range wishlists {
+		if wishlist != nil && wishlist.UserID == user.ID {
+			productIDs = append(productIDs, wishlist.ProductID)
+		}
+	}
+	wishlistMux.RUnlock()
+
+	cfg := currentConfig()
+	response := WishlistValueResponse{}
+	for _, productID := range productIDs {
+		productMux.RLock()
+		product := products[productID]
+		productMux.RUnlock()
+		if product == nil {
+			continue // 削除済みの商品は対象外
+		}
+
+		totalStock, _ := getProductStock(product.ID)
+		response.ItemCount++
+		response.TotalValue += product.Price
+		if sellableStock(cfg, product, totalStock) > 0 {
+			response.InStockCount++
+			response.InStockValue += product.Price
+		} else {
+			response.OutOfStockCount++
+		}
+	}
+
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// カートの検証（チェックアウト前に商品の存在・在庫・価格変更を確認する）
+func validateCartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req struct {
+		Items []struct {
+			ProductID     int `json:"product_id"`
+			Quantity      int `json:"quantity"`
+			ExpectedPrice int `json:"expected_price,omitempty"` // 省略時は価格変更を判定しない
+		} `json:"items"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Items) == 0 {
+		errorResponse(w, http.StatusBadRequest, "No items in cart")
+		return
+	}
+	cfg := currentConfig()
+	if len(req.Items) > cfg.MaxOrderItems {
+		errorResponse(w, http.StatusBadRequest, "Too many items")
+		return
+	}
+
+	orderItems := make([]OrderItem, len(req.Items))
+	for i, item := range req.Items {
+		if item.Quantity <= 0 {
+			errorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid quantity for item %d", i))
+			return
+		}
+		orderItems[i] = OrderItem{ProductID: item.ProductID, Quantity: item.Quantity}
+	}
+	availability := checkStockAvailability(cfg, orderItems)
+
+	response := CartValidationResponse{Valid: true, Items: []CartValidationItem{}}
+	for i, item := range req.Items {
+		result := CartValidationItem{
+			ProductID:     item.ProductID,
+			Quantity:      item.Quantity,
+			ExpectedPrice: item.ExpectedPrice,
+		}
+
+		productMux.RLock()
+		product := products[item.ProductID]
+		if product != nil {
+			result.Exists = true
+			result.Name = product.Name
+			result.CurrentPrice = product.Price
+			// 販売開始前の商品は注文できない
+			result.Available = availability[i].Sufficient && !isPreOrder(product)
+			result.AvailableStock = availability[i].Available
+		}
+		productMux.RUnlock()
+
+		if result.Exists && item.ExpectedPrice > 0 && item.ExpectedPrice != result.CurrentPrice {
+			result.PriceChanged = true
+		}
+		if !result.Available || result.PriceChanged {
+			response.Valid = false
+		}
+		response.Items = append(response.Items, result)
 	}
-	return false
-}
 
-// ポイント使用のロールバック
-func rollbackPoints(userID int, orderID int, points int) {
-	userMux.Lock()
-	defer userMux.Unlock()
+	jsonResponse(w, http.StatusOK, response)
+}
 
-	if user, exists := users[userID]; exists {
-		user.CurrentPoints += points
+// カートの内容を応答用に組み立てる（削除済み商品は available=false で返す）
+func buildCartResponse(cfg Config, userID int) CartResponse {
+	cartMux.RLock()
+	var items []CartItem
+	if cart := carts[userID]; cart != nil {
+		items = append(items, cart.Items...)
+	}
+	cartMux.RUnlock()
 
-		// ロールバック履歴を記録（キャンセルとして）
-		pointHistoryMux.Lock()
-		history := &PointHistory{
-			ID:        nextPointHistoryID,
-			UserID:    userID,
-			OrderID:   orderID,
-			Type:      "rollback",
-			Amount:    points,
-			Balance:   user.CurrentPoints,
-			CreatedAt: time.Now(),
+	sales := activeCategorySales(time.Now())
+	response := CartResponse{Items: []CartLine{}}
+	productMux.RLock()
+	for _, item := range items {
+		line := CartLine{ProductID: item.ProductID, Quantity: item.Quantity}
+		if product := products[item.ProductID]; product != nil {
+			line.Name = product.Name
+			line.UnitPrice = unitPriceFor(product, item.Quantity)
+			line.SaleDiscount = saleDiscountFor(cfg, product, item.Quantity, sales)
+			line.LineTotal = line.UnitPrice*item.Quantity - line.SaleDiscount
+			line.Available = true
+			response.Subtotal += line.LineTotal
 		}
-		pointHistories[nextPointHistoryID] = history
-		nextPointHistoryID++
-		pointHistoryMux.Unlock()
+		response.Items = append(response.Items, line)
 	}
+	productMux.RUnlock()
+
+	return response
 }
 
-// ハンドラー関数
+var errCartFull = errors.New("too many items in cart")
 
-// 商品一覧取得（カテゴリフィルタ対応）
-func getProductsHandler(w http.ResponseWriter, r *http.Request) {
+// カートに商品を追加する（既にある商品は数量を加算）
+// 呼び出し側で productMux（商品の存在確認）と cartMux をロックしていること
+func addCartItem(cfg Config, userID, productID, quantity int) error {
+	cart := carts[userID]
+	if cart == nil {
+		cart = &Cart{UserID: userID}
+		carts[userID] = cart
+	}
+	for i := range cart.Items {
+		if cart.Items[i].ProductID == productID {
+			cart.Items[i].Quantity += quantity
+			cart.UpdatedAt = time.Now()
+			return nil
+		}
+	}
+	if len(cart.Items) >= cfg.MaxOrderItems {
+		return errCartFull
+	}
+	cart.Items = append(cart.Items, CartItem{ProductID: productID, Quantity: quantity})
+	cart.UpdatedAt = time.Now()
+	return nil
+}
+
+// カートの取得
+func getCartHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
-	category := r.URL.Query().Get("category")
-
-	// 認証ユーザーを取得
+	// 認証確認
 	user := getAuthUser(r)
-	var userID int
-	if user != nil {
-		userID = user.ID
-	}
-
-	productMux.RLock()
-	defer productMux.RUnlock()
-
-	var result []ProductDetailResponseWithFavorite
-	for _, p := range products {
-		if category == "" || p.Category == category {
-			totalStock, stockDetails := getProductStock(p.ID)
-			isFavorite := false
-			if user != nil {
-				isFavorite = isProductInWishlist(userID, p.ID)
-			}
-			result = append(result, ProductDetailResponseWithFavorite{
-				ID:          p.ID,
-				Name:        p.Name,
-				Price:       p.Price,
-				Category:    p.Category,
-				TotalStock:  totalStock,
-				StockDetail: stockDetails,
-				IsFavorite:  isFavorite,
-			})
-		}
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
 	}
+	cfg := currentConfig()
 
-	jsonResponse(w, http.StatusOK, result)
+	jsonResponse(w, http.StatusOK, buildCartResponse(cfg, user.ID))
 }
 
-// 商品詳細取得
-func getProductHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
+// カートへの商品追加
+func addCartItemHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
 		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
-	// URLから商品IDを取得
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 3 {
-		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
+	cfg := currentConfig()
 
-	id, err := strconv.Atoi(parts[2])
-	if err != nil {
-		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+	var req CartItem
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Quantity <= 0 {
+		errorResponse(w, http.StatusBadRequest, "Invalid quantity")
 		return
 	}
 
+	// 商品の存在確認と追加を同じロックの中で行う（ロック順序は product → cart）
 	productMux.RLock()
-	product := products[id]
+	if products[req.ProductID] == nil {
+		productMux.RUnlock()
+		errorResponse(w, http.StatusNotFound, "Product not found")
+		return
+	}
+	cartMux.Lock()
+	err := addCartItem(cfg, user.ID, req.ProductID, req.Quantity)
+	cartMux.Unlock()
 	productMux.RUnlock()
 
-	if product == nil {
-		errorResponse(w, http.StatusNotFound, "Product not found")
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Too many items")
 		return
 	}
 
-	// 認証ユーザーを取得
+	jsonResponse(w, http.StatusOK, buildCartResponse(cfg, user.ID))
+}
+
+// カートからの商品削除
+func removeCartItemHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// 認証確認
 	user := getAuthUser(r)
-	isFavorite := false
-	if user != nil {
-		isFavorite = isProductInWishlist(user.ID, product.ID)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
 	}
+	cfg := currentConfig()
 
-	// 倉庫別在庫情報を取得
-	totalStock, stockDetails := getProductStock(product.ID)
+	// URLから商品IDを取得（/cart/items/{product_id}）
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 {
+		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+	productID, err := strconv.Atoi(parts[3])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
 
-	response := ProductDetailResponseWithFavorite{
-		ID:          product.ID,
-		Name:        product.Name,
-		Price:       product.Price,
-		Category:    product.Category,
-		TotalStock:  totalStock,
-		StockDetail: stockDetails,
-		IsFavorite:  isFavorite,
+	removed := false
+	cartMux.Lock()
+	if cart := carts[user.ID]; cart != nil {
+		for i, item := range cart.Items {
+			if item.ProductID == productID {
+				cart.Items = append(cart.Items[:i], cart.Items[i+1:]...)
+				cart.UpdatedAt = time.Now()
+				removed = true
+				break
+			}
+		}
 	}
+	cartMux.Unlock()
 
-	jsonResponse(w, http.StatusOK, response)
+	if !removed {
+		errorResponse(w, http.StatusNotFound, "Product not in cart")
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, buildCartResponse(cfg, user.ID))
 }
 
-// 商品作成（管理者のみ）
-func createProductHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
+// カートの商品の数量変更
+func updateCartItemHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PATCH" {
 		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
@@ -891,175 +7305,328 @@ func createProductHandler(w http.ResponseWriter, r *http.Request) {
 		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
+	cfg := currentConfig()
 
-	// 管理者権限確認
-	if !user.IsAdmin {
-		errorResponse(w, http.StatusForbidden, "Admin access required")
+	// URLから商品IDを取得（/cart/items/{product_id}）
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 {
+		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+	productID, err := strconv.Atoi(parts[3])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
 		return
 	}
 
 	var req struct {
-		Name         string `json:"name"`
-		Price        int    `json:"price"`
-		Category     string `json:"category"`
-		InitialStock int    `json:"initial_stock"` // 初期在庫（東京倉庫に配置）
+		Quantity int `json:"quantity"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		errorResponse(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// 数量0での削除は DELETE で行う
+	if req.Quantity <= 0 {
+		errorResponse(w, http.StatusBadRequest, "Invalid quantity")
 		return
 	}
 
-	// バリデーション
-	if req.Name == "" || req.Price <= 0 || req.InitialStock < 0 || req.Category == "" {
-		errorResponse(w, http.StatusBadRequest, "Invalid product data")
+	updated := false
+	cartMux.Lock()
+	if cart := carts[user.ID]; cart != nil {
+		for i := range cart.Items {
+			if cart.Items[i].ProductID == productID {
+				cart.Items[i].Quantity = req.Quantity
+				cart.UpdatedAt = time.Now()
+				updated = true
+				break
+			}
+		}
+	}
+	cartMux.Unlock()
+
+	if !updated {
+		errorResponse(w, http.StatusNotFound, "Product not in cart")
 		return
 	}
 
-	productMux.Lock()
-	product := Product{
-		ID:       nextProductID,
-		Name:     req.Name,
-		Price:    req.Price,
-		Category: req.Category,
+	jsonResponse(w, http.StatusOK, buildCartResponse(cfg, user.ID))
+}
+
+// カートの内容で注文する（注文作成と同じ処理で在庫確認・決済を行い、成功したらカートから取り除く）
+// ボディは省略可能で、クーポン・ポイント・配送先は POST /orders と同じ形式で指定する（items は無視）
+func checkoutCartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
 	}
-	nextProductID++
-	products[product.ID] = &product
-	productMux.Unlock()
 
-	// 初期在庫を東京倉庫（ID=1）に設定
-	if req.InitialStock > 0 {
-		stockMux.Lock()
-		key := fmt.Sprintf("%d-%d", product.ID, 1)
-		stocks[key] = &Stock{
-			ProductID:   product.ID,
-			WarehouseID: 1,
-			Quantity:    req.InitialStock,
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req CreateOrderRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSONBody(r, &req); err != nil {
+			errorResponse(w, http.StatusBadRequest, err.Error())
+			return
 		}
-		stockMux.Unlock()
 	}
 
-	// レスポンス用に在庫情報を含める
-	totalStock, stockDetails := getProductStock(product.ID)
-	response := ProductDetailResponse{
-		ID:          product.ID,
-		Name:        product.Name,
-		Price:       product.Price,
-		Category:    product.Category,
-		TotalStock:  totalStock,
-		StockDetail: stockDetails,
+	cartMux.RLock()
+	req.Items = nil
+	if cart := carts[user.ID]; cart != nil {
+		for _, item := range cart.Items {
+			req.Items = append(req.Items, OrderItem{ProductID: item.ProductID, Quantity: item.Quantity})
+		}
+	}
+	cartMux.RUnlock()
+
+	if len(req.Items) == 0 {
+		errorResponse(w, http.StatusBadRequest, "Cart is empty")
+		return
+	}
+
+	if !placeOrder(w, r, user, req) {
+		return
 	}
 
-	jsonResponse(w, http.StatusCreated, response)
+	// 注文した数量をカートから取り除く（チェックアウト中に追加された分は残す）
+	cartMux.Lock()
+	if cart := carts[user.ID]; cart != nil {
+		ordered := make(map[int]int)
+		for _, item := range req.Items {
+			ordered[item.ProductID] += item.Quantity
+		}
+		items := cart.Items[:0]
+		for _, item := range cart.Items {
+			item.Quantity -= ordered[item.ProductID]
+			if item.Quantity > 0 {
+				items = append(items, item)
+			}
+		}
+		cart.Items = items
+		cart.UpdatedAt = time.Now()
+	}
+	cartMux.Unlock()
 }
 
-// ユーザー登録
-func registerHandler(w http.ResponseWriter, r *http.Request) {
+// ゲストカートの統合（ログイン前に作ったカートの商品をユーザーのカートに加える）
+// 存在しない商品や数量が不正な明細はスキップし、skipped に商品IDを返す
+func mergeCartHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
-	var req struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
 	}
+	cfg := currentConfig()
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		errorResponse(w, http.StatusBadRequest, "Invalid request body")
+	var req struct {
+		Items []CartItem `json:"items"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	if req.Username == "" || req.Password == "" {
-		errorResponse(w, http.StatusBadRequest, "Username and password required")
+	skipped := []int{}
+	productMux.RLock()
+	cartMux.Lock()
+	for _, item := range req.Items {
+		if item.Quantity <= 0 || products[item.ProductID] == nil {
+			skipped = append(skipped, item.ProductID)
+			continue
+		}
+		if err := addCartItem(cfg, user.ID, item.ProductID, item.Quantity); err != nil {
+			skipped = append(skipped, item.ProductID)
+		}
+	}
+	cartMux.Unlock()
+	productMux.RUnlock()
+
+	response := buildCartResponse(cfg, user.ID)
+	response.Skipped = skipped
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// ページングのデフォルト値
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// クエリパラメータ limit / offset を解釈する
+func parsePagination(r *http.Request) (limit, offset int, err error) {
+	limit = defaultPageLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxPageLimit {
+			return 0, 0, fmt.Errorf("invalid limit (must be 1-%d)", maxPageLimit)
+		}
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+	}
+	return limit, offset, nil
+}
+
+// ポイント履歴取得ハンドラー
+func getPointHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
-	userMux.Lock()
-	defer userMux.Unlock()
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
 
-	// ユーザー名の重複チェック
-	if usersByName[req.Username] != nil {
-		errorResponse(w, http.StatusConflict, "Username already exists")
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// パスワードハッシュ化
-	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	page, err := buildPointHistoryPage(user.ID, r.URL.Query().Get("sort"), limit, offset)
 	if err != nil {
-		errorResponse(w, http.StatusInternalServerError, "Failed to process password")
+		errorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	user := &User{
-		ID:               nextUserID,
-		Username:         req.Username,
-		PasswordHash:     string(hash),
-		IsAdmin:          false,
-		CurrentPoints:    0,
-		TotalSpentAmount: 0,
-		MemberRank:       "Normal",
+	jsonResponse(w, http.StatusOK, page)
+}
+
+// ユーザーのポイント履歴を並び替えてページングする（order は asc / desc、空の場合は desc）
+func buildPointHistoryPage(userID int, order string, limit, offset int) (PointHistoryPage, error) {
+	// 並び順（デフォルトは新しい順）
+	if order == "" {
+		order = "desc"
+	}
+	if order != "asc" && order != "desc" {
+		return PointHistoryPage{}, errors.New("Invalid sort (must be asc or desc)")
 	}
 
-	nextUserID++
-	users[user.ID] = user
-	usersByName[user.Username] = user
+	var histories []*PointHistory
+	pointHistoryMux.RLock()
+	for _, history := range pointHistories {
+		if history.UserID == userID {
+			histories = append(histories, history)
+		}
+	}
+	pointHistoryMux.RUnlock()
 
-	// トークン生成
-	token := generateToken()
-	sessionMux.Lock()
-	sessions[token] = user
-	sessionMux.Unlock()
+	// 作成日時順（同時刻は履歴ID順）
+	sort.Slice(histories, func(i, j int) bool {
+		a, b := histories[i], histories[j]
+		if order == "desc" {
+			a, b = b, a
+		}
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	})
+
+	page := PointHistoryPage{
+		Total:  len(histories),
+		Limit:  limit,
+		Offset: offset,
+		Items:  []*PointHistory{},
+	}
+	if offset < len(histories) {
+		end := offset + limit
+		if end > len(histories) {
+			end = len(histories)
+		}
+		page.Items = histories[offset:end]
+	}
 
-	user.Token = token
-	jsonResponse(w, http.StatusCreated, user)
+	return page, nil
 }
 
-// ログイン
-func loginHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
+// ユーザーのポイント残高と履歴を取得（管理者のみ）
+func getAdminUserPointsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
 		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
-	var req struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		errorResponse(w, http.StatusBadRequest, "Invalid request body")
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
 		return
 	}
 
-	userMux.RLock()
-	user := usersByName[req.Username]
-	userMux.RUnlock()
+	// URLからユーザーIDを取得 (/admin/users/{id}/points)
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 5 || parts[4] != "points" {
+		errorResponse(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	targetUserID, err := strconv.Atoi(parts[3])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
 
-	if user == nil {
-		errorResponse(w, http.StatusUnauthorized, "Invalid credentials")
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// パスワード検証
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
-		errorResponse(w, http.StatusUnauthorized, "Invalid credentials")
+	userMux.RLock()
+	target, exists := users[targetUserID]
+	var response AdminUserPointsResponse
+	if exists {
+		response = AdminUserPointsResponse{
+			UserID:        target.ID,
+			Username:      target.Username,
+			CurrentPoints: target.CurrentPoints,
+		}
+	}
+	userMux.RUnlock()
+	if !exists {
+		errorResponse(w, http.StatusNotFound, "User not found")
 		return
 	}
 
-	// トークン生成
-	token := generateToken()
-	sessionMux.Lock()
-	sessions[token] = user
-	sessionMux.Unlock()
+	page, err := buildPointHistoryPage(targetUserID, r.URL.Query().Get("sort"), limit, offset)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	response.History = page
 
-	response := *user
-	response.Token = token
 	jsonResponse(w, http.StatusOK, response)
 }
 
-// 注文作成
-func createOrderHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
+// ユーザーの顧客生涯価値を取得（管理者のみ）
+func getUserLTVHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
 		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
@@ -1071,240 +7638,165 @@ func createOrderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req struct {
-		Items      []OrderItem `json:"items"`
-		CouponCode string      `json:"coupon_code,omitempty"`
-		UsePoints  int         `json:"use_points,omitempty"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		errorResponse(w, http.StatusBadRequest, "Invalid request body")
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
 		return
 	}
 
-	if len(req.Items) == 0 {
-		errorResponse(w, http.StatusBadRequest, "No items in order")
+	// URLからユーザーIDを取得 (/admin/users/{id}/ltv)
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 5 || parts[4] != "ltv" {
+		errorResponse(w, http.StatusBadRequest, "Invalid user ID")
 		return
 	}
-
-	// ポイント使用のバリデーション
-	if req.UsePoints < 0 {
-		errorResponse(w, http.StatusBadRequest, "Invalid use_points value")
+	targetUserID, err := strconv.Atoi(parts[3])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid user ID")
 		return
 	}
 
 	userMux.RLock()
-	currentUserPoints := user.CurrentPoints
-	currentUserRank := user.MemberRank
+	target, exists := users[targetUserID]
+	var response UserLTVResponse
+	if exists {
+		response = UserLTVResponse{UserID: target.ID, Username: target.Username}
+	}
 	userMux.RUnlock()
-
-	if req.UsePoints > currentUserPoints {
-		errorResponse(w, http.StatusBadRequest, fmt.Sprintf("Insufficient points. Available: %d, Requested: %d", currentUserPoints, req.UsePoints))
+	if !exists {
+		errorResponse(w, http.StatusNotFound, "User not found")
 		return
 	}
 
-	// クーポンコードのバリデーション
-	var appliedCoupon *Coupon
-	if req.CouponCode != "" {
-		couponMux.RLock()
-		appliedCoupon = coupons[req.CouponCode]
-		couponMux.RUnlock()
-
-		if appliedCoupon == nil {
-			errorResponse(w, http.StatusBadRequest, "Invalid coupon code")
-			return
-		}
-	}
-
-	// 在庫チェックと基本価格計算
-	subtotal := 0
-	orderProducts := make([]*Product, len(req.Items))
-	stockAllocations := make(map[int]map[int]int) // productID -> warehouseID -> quantity
-
-	// 商品の存在確認と基本価格計算
-	productMux.RLock()
-	for i, item := range req.Items {
-		if item.Quantity <= 0 {
-			productMux.RUnlock()
-			errorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid quantity for item %d", i))
-			return
+	var first, last time.Time
+	orderMux.RLock()
+	for _, order := range orders {
+		// 全額返金した注文も支払額と返金額の両方に含める
+		if order.UserID != targetUserID || !(isCompletedSale(order) || order.Status == "refunded") {
+			continue
 		}
-
-		product := products[item.ProductID]
-		if product == nil {
-			productMux.RUnlock()
-			errorResponse(w, http.StatusNotFound, fmt.Sprintf("Product %d not found", item.ProductID))
-			return
+		response.OrderCount++
+		response.TotalRevenue += order.TotalPrice
+		for _, refund := range order.Refunds {
+			response.RefundedAmount += refund.Amount
 		}
-
-		// 総在庫数を確認
-		totalStock, _ := getProductStock(product.ID)
-		if totalStock < item.Quantity {
-			productMux.RUnlock()
-			errorResponse(w, http.StatusBadRequest,
-				fmt.Sprintf("Insufficient stock for product %s (available: %d, requested: %d)",
-					product.Name, totalStock, item.Quantity))
-			return
+		if first.IsZero() || order.CreatedAt.Before(first) {
+			first = order.CreatedAt
 		}
-
-		orderProducts[i] = product
-		subtotal += product.Price * item.Quantity
-		stockAllocations[product.ID] = make(map[int]int)
-	}
-	productMux.RUnlock()
-
-	// 支払い金額の算出アルゴリズム（MT-8仕様書の順序に従う）
-	// 1. 商品小計の算出（会員ランク割引を適用）
-	rankDiscountRate := getRankDiscountRate(currentUserRank)
-	rankDiscountAmount := int(float64(subtotal) * rankDiscountRate)
-	discountedSubtotal := subtotal - rankDiscountAmount
-
-	// 2. 消費税の加算（ランク割引後の小計に対し10%）
-	tax := discountedSubtotal / 10
-	subtotalWithTax := discountedSubtotal + tax
-
-	// 3. 送料の確定
-	shippingFee := 0
-	if currentUserRank != "Gold" { // ゴールド会員は常に送料無料
-		if subtotalWithTax < 5000 {
-			shippingFee = 500
+		if order.CreatedAt.After(last) {
+			last = order.CreatedAt
 		}
 	}
+	orderMux.RUnlock()
 
-	// 4. クーポン割引の適用（商品代金＋消費税に対して、送料は対象外）
-	couponDiscountAmount := calculateCouponDiscount(appliedCoupon, subtotalWithTax)
-	afterCouponAmount := subtotalWithTax - couponDiscountAmount
-
-	// 5. ポイント利用（最後に差し引く）
-	afterPointsAmount := afterCouponAmount + shippingFee - req.UsePoints
-	if afterPointsAmount < 0 {
-		afterPointsAmount = 0
+	if response.OrderCount > 0 {
+		response.AverageOrderValue = response.TotalRevenue / response.OrderCount
+		response.FirstOrderAt = &first
+		response.LastOrderAt = &last
+		days := int(time.Since(last) / (24 * time.Hour))
+		response.DaysSinceLastOrder = &days
 	}
 
-	// 最終金額
-	totalPrice := afterPointsAmount
-
-	// 注文IDを先に生成（決済処理で必要）
-	orderID := nextOrderID
-
-	// ポイント付与の計算（最終支払額の1%、小数点以下切り捨て）
-	earnedPoints := totalPrice / 100
+	jsonResponse(w, http.StatusOK, response)
+}
 
-	// ポイントを使用（決済前に仮で減算）
-	pointsUsed := false
-	if req.UsePoints > 0 {
-		pointsUsed = usePoints(user.ID, orderID, req.UsePoints)
-		if !pointsUsed {
-			errorResponse(w, http.StatusInternalServerError, "Failed to use points")
-			return
-		}
+// 注文履歴のCSVエクスポート
+func exportOrdersCSVHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
 	}
 
-	// 決済処理を実行（在庫減算前）
-	paymentResult := paymentGateway.ProcessPayment(totalPrice, orderID)
-
-	// 注文オブジェクトを作成
-	order := &Order{
-		ID:             orderID,
-		UserID:         user.ID,
-		Items:          req.Items,
-		TotalPrice:     totalPrice,
-		ShippingFee:    shippingFee,
-		DiscountAmount: couponDiscountAmount,
-		AppliedCoupon:  req.CouponCode,
-		CreatedAt:      time.Now(),
-		EarnedPoints:   earnedPoints,
-		UsedPoints:     req.UsePoints,
-		RankDiscount:   rankDiscountAmount,
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
 	}
 
-	if paymentResult.Success {
-		// 決済成功時のみ在庫を減らす
-		allAllocated := true
-		for _, item := range req.Items {
-			allocated, allocations := allocateStock(item.ProductID, item.Quantity)
-			if !allocated {
-				allAllocated = false
-				break
-			}
-			stockAllocations[item.ProductID] = allocations
-		}
-
-		if !allAllocated {
-			// 在庫割り当て失敗（競合状態などで発生する可能性あり）
-			// ポイントをロールバック
-			if pointsUsed {
-				rollbackPoints(user.ID, orderID, req.UsePoints)
-			}
-			order.Status = "payment_failed"
-			orderMux.Lock()
-			nextOrderID++
-			orders[order.ID] = order
-			orderMux.Unlock()
-			errorResponse(w, http.StatusConflict, "Stock allocation failed. Please retry.")
-			return
-		}
-
-		order.Status = "completed"
-
-		// ポイントを付与
-		if earnedPoints > 0 {
-			addPoints(user.ID, orderID, earnedPoints)
+	var userOrders []Order
+	orderMux.RLock()
+	for _, order := range orders {
+		if order.UserID == user.ID {
+			userOrders = append(userOrders, *order)
 		}
+	}
+	orderMux.RUnlock()
 
-		// ユーザーの累計購入金額とランクを更新
-		updateUserPurchaseAmountAndRank(user.ID, totalPrice)
-
-		// 更新後のユーザー情報を取得
-		userMux.RLock()
-		updatedUser := users[user.ID]
-		newTotalPoints := updatedUser.CurrentPoints
-		newRank := updatedUser.MemberRank
-		userMux.RUnlock()
-
-		// 注文を保存
-		orderMux.Lock()
-		nextOrderID++
-		orders[order.ID] = order
-		orderMux.Unlock()
-
-		// 成功レスポンスにトランザクションIDとポイント情報を含める
-		response := struct {
-			*Order
-			TransactionID    string `json:"transaction_id"`
-			NewTotalPoints   int    `json:"new_total_points"`
-			CurrentRank      string `json:"current_rank"`
-		}{
-			Order:            order,
-			TransactionID:    paymentResult.TransactionID,
-			NewTotalPoints:   newTotalPoints,
-			CurrentRank:      newRank,
+	// 注文日時順（同時刻は注文ID順）
+	sort.Slice(userOrders, func(i, j int) bool {
+		if !userOrders[i].CreatedAt.Equal(userOrders[j].CreatedAt) {
+			return userOrders[i].CreatedAt.Before(userOrders[j].CreatedAt)
 		}
+		return userOrders[i].ID < userOrders[j].ID
+	})
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="orders.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"date", "order_id", "total", "status", "coupon", "points_used", "points_earned"})
+	for _, order := range userOrders {
+		writer.Write([]string{
+			order.CreatedAt.Format(time.RFC3339),
+			strconv.Itoa(order.ID),
+			strconv.Itoa(order.TotalPrice),
+			order.Status,
+			order.AppliedCoupon,
+			strconv.Itoa(order.UsedPoints),
+			strconv.Itoa(order.EarnedPoints),
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("Failed to write orders CSV for user %d: %v", user.ID, err)
+	}
+}
 
-		jsonResponse(w, http.StatusCreated, response)
-	} else {
-		// 決済失敗時は在庫を減らさない
-		// ポイントの使用もロールバック
-		if pointsUsed {
-			rollbackPoints(user.ID, orderID, req.UsePoints)
-		}
+// 公開プロフィール取得ハンドラー
+// ポイントや購入金額などの個人情報は、リクエスト元に関係なく返さない
+func getPublicProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
 
-		order.Status = "payment_failed"
+	// URLからユーザーIDを取得 (/users/{id}/profile)
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 || parts[3] != "profile" {
+		errorResponse(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	userID, err := strconv.Atoi(parts[2])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
 
-		// 失敗した注文も記録（監査目的）
-		orderMux.Lock()
-		nextOrderID++
-		orders[order.ID] = order
-		orderMux.Unlock()
+	userMux.RLock()
+	user := users[userID]
+	var response PublicProfileResponse
+	if user != nil {
+		response = PublicProfileResponse{
+			ID:          user.ID,
+			Username:    user.Username,
+			Rank:        user.MemberRank,
+			MemberSince: user.CreatedAt,
+		}
+	}
+	userMux.RUnlock()
 
-		// エラーレスポンス
-		errorResponse(w, http.StatusPaymentRequired,
-			fmt.Sprintf("Payment failed: %s", paymentResult.Message))
+	if user == nil {
+		errorResponse(w, http.StatusNotFound, "User not found")
+		return
 	}
+
+	jsonResponse(w, http.StatusOK, response)
 }
 
-// 注文一覧取得（ユーザー自身の注文のみ）
-func getOrdersHandler(w http.ResponseWriter, r *http.Request) {
+// ランクアップ進捗取得ハンドラー
+func getRankProgressHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
@@ -1317,21 +7809,35 @@ func getOrdersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	orderMux.RLock()
-	defer orderMux.RUnlock()
+	userMux.RLock()
+	totalSpent := user.TotalSpentAmount
+	rank := user.MemberRank
+	userMux.RUnlock()
 
-	var userOrders []*Order
-	for _, order := range orders {
-		if order.UserID == user.ID {
-			userOrders = append(userOrders, order)
-		}
+	response := RankProgressResponse{
+		CurrentRank: rank,
+		TotalSpent:  totalSpent,
 	}
 
-	jsonResponse(w, http.StatusOK, userOrders)
+	next, hasNext := nextRankTier(totalSpent)
+	if !hasNext {
+		response.IsMaxRank = true
+		response.ProgressPercent = 100
+		jsonResponse(w, http.StatusOK, response)
+		return
+	}
+
+	current := rankTierFor(totalSpent)
+	response.NextRank = next.Name
+	response.NextRankThreshold = next.MinSpent
+	response.AmountToNextRank = next.MinSpent - totalSpent
+	response.ProgressPercent = (totalSpent - current.MinSpent) * 100 / (next.MinSpent - current.MinSpent)
+
+	jsonResponse(w, http.StatusOK, response)
 }
 
-// 販売分析レポート取得（管理者のみ）
-func getSalesReportHandler(w http.ResponseWriter, r *http.Request) {
+// 仮の購入金額によるランク変化のプレビュー（「あと○円でGold」表示用）
+func getRankPreviewHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
@@ -1344,20 +7850,38 @@ func getSalesReportHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 管理者権限確認
-	if !user.IsAdmin {
-		errorResponse(w, http.StatusForbidden, "Admin access required")
+	amount, err := strconv.Atoi(r.URL.Query().Get("amount"))
+	if err != nil || amount < 0 {
+		errorResponse(w, http.StatusBadRequest, "Invalid amount (must be a non-negative integer)")
 		return
 	}
 
-	// レポート生成
-	report := generateSalesReport()
-	jsonResponse(w, http.StatusOK, report)
+	userMux.RLock()
+	totalSpent := user.TotalSpentAmount
+	rank := user.MemberRank
+	userMux.RUnlock()
+
+	projectedTotal := totalSpent + amount
+	response := RankPreviewResponse{
+		CurrentRank:    rank,
+		TotalSpent:     totalSpent,
+		Amount:         amount,
+		ProjectedTotal: projectedTotal,
+		ProjectedRank:  calculateMemberRank(projectedTotal),
+	}
+	response.RankChanged = response.ProjectedRank != rank
+
+	if next, hasNext := nextRankTier(projectedTotal); hasNext {
+		response.NextRank = next.Name
+		response.AmountToNext = next.MinSpent - projectedTotal
+	}
+
+	jsonResponse(w, http.StatusOK, response)
 }
 
-// お気に入り追加ハンドラー
-func addToWishlistHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
+// おすすめ商品取得ハンドラー
+func getRecommendationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
 		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
@@ -1369,43 +7893,120 @@ func addToWishlistHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// URLから商品IDを取得
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 3 {
-		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+	// おすすめ商品を取得
+	recommendations := getRecommendations(user.ID)
+	jsonResponse(w, http.StatusOK, recommendations)
+}
+
+// 繰り返し購入している商品とみなす注文件数の下限
+const minFrequentOrderCount = 2
+
+// 繰り返し購入している商品の一覧（定期購入の提案用）
+// 完了注文（completed / shipped / partially_refunded）のうち、同じ商品を含む注文が2件以上あるものを
+// 注文件数の多い順（同数なら最後に注文した日時の新しい順）に返す。購入金額特典のプレゼントは数えない
+func getFrequentProductsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
-	productID, err := strconv.Atoi(parts[2])
-	if err != nil {
-		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	// 商品の存在確認
-	productMux.RLock()
-	product := products[productID]
-	productMux.RUnlock()
+	jsonResponse(w, http.StatusOK, getFrequentProducts(user.ID))
+}
 
-	if product == nil {
-		errorResponse(w, http.StatusNotFound, "Product not found")
+func getFrequentProducts(userID int) []FrequentProduct {
+	byProduct := make(map[int]*FrequentProduct)
+	orderMux.RLock()
+	for _, order := range orders {
+		if order.UserID != userID || !isCompletedSale(order) {
+			continue
+		}
+		// 同じ注文内で同じ商品が複数明細に分かれていても1件と数える
+		counted := make(map[int]bool)
+		for _, item := range order.Items {
+			if item.IsGift {
+				continue
+			}
+			fp := byProduct[item.ProductID]
+			if fp == nil {
+				fp = &FrequentProduct{ProductID: item.ProductID}
+				byProduct[item.ProductID] = fp
+			}
+			fp.TotalQuantity += item.Quantity
+			if !counted[item.ProductID] {
+				counted[item.ProductID] = true
+				fp.OrderCount++
+			}
+			if order.CreatedAt.After(fp.LastOrderedAt) {
+				fp.LastOrderedAt = order.CreatedAt
+				fp.ProductName = item.ProductName
+			}
+		}
+	}
+	orderMux.RUnlock()
+
+	result := []FrequentProduct{}
+	for _, fp := range byProduct {
+		if fp.OrderCount >= minFrequentOrderCount {
+			result = append(result, *fp)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].OrderCount != result[j].OrderCount {
+			return result[i].OrderCount > result[j].OrderCount
+		}
+		if !result[i].LastOrderedAt.Equal(result[j].LastOrderedAt) {
+			return result[i].LastOrderedAt.After(result[j].LastOrderedAt)
+		}
+		return result[i].ProductID < result[j].ProductID
+	})
+	return result
+}
+
+// ユーザー情報取得ハンドラー
+func getUserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
-	// お気に入りに追加
-	if addToWishlist(user.ID, productID) {
-		jsonResponse(w, http.StatusCreated, map[string]interface{}{
-			"message":    "Added to wishlist",
-			"product_id": productID,
-		})
-	} else {
-		errorResponse(w, http.StatusConflict, "Product already in wishlist")
+	// 認証確認
+	user := getAuthUser(r)
+	if user == nil {
+		errorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
 	}
+
+	// ユーザー情報をレスポンス用構造体に変換
+	jsonResponse(w, http.StatusOK, buildUserInfoResponse(user))
 }
 
-// お気に入り削除ハンドラー
-func removeFromWishlistHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "DELETE" {
+// ユーザー情報をレスポンス用構造体に変換する（パスワードハッシュ等は含めない）
+func buildUserInfoResponse(user *User) UserInfoResponse {
+	return UserInfoResponse{
+		ID:               user.ID,
+		Username:         user.Username,
+		IsAdmin:          user.IsAdmin,
+		Rank:             user.MemberRank,
+		TotalSpentAmount: user.TotalSpentAmount,
+		CurrentPoints:    user.CurrentPoints,
+		CreatedAt:        user.CreatedAt,
+	}
+}
+
+// 一度に取得できるユーザー数の上限
+const maxUserBatchSize = 100
+
+// 複数ユーザーの情報を一括取得（管理者のみ）
+// 存在しないIDは結果から除外し、結果はリクエストのID順（重複は1件にまとめる）
+func getUsersBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
 		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
@@ -1417,33 +8018,63 @@ func removeFromWishlistHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// URLから商品IDを取得
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 3 {
-		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+	// 管理者権限確認
+	if !user.IsAdmin {
+		errorResponse(w, http.StatusForbidden, "Admin access required")
 		return
 	}
 
-	productID, err := strconv.Atoi(parts[2])
-	if err != nil {
-		errorResponse(w, http.StatusBadRequest, "Invalid product ID")
+	var req struct {
+		IDs []int `json:"ids"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.IDs) == 0 {
+		errorResponse(w, http.StatusBadRequest, "No user IDs specified")
+		return
+	}
+	if len(req.IDs) > maxUserBatchSize {
+		errorResponse(w, http.StatusBadRequest, fmt.Sprintf("Too many user IDs (max %d)", maxUserBatchSize))
 		return
 	}
 
-	// お気に入りから削除
-	if removeFromWishlist(user.ID, productID) {
-		jsonResponse(w, http.StatusOK, map[string]interface{}{
-			"message":    "Removed from wishlist",
-			"product_id": productID,
-		})
-	} else {
-		errorResponse(w, http.StatusNotFound, "Product not in wishlist")
+	response := []UserInfoResponse{}
+	seen := make(map[int]bool)
+
+	userMux.RLock()
+	for _, id := range req.IDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if u := users[id]; u != nil {
+			response = append(response, buildUserInfoResponse(u))
+		}
 	}
+	userMux.RUnlock()
+
+	jsonResponse(w, http.StatusOK, response)
 }
 
-// おすすめ商品取得ハンドラー
-func getRecommendationsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
+// 管理者アカウントの数（呼び出し側で userMux を保持していること）
+func countAdmins() int {
+	count := 0
+	for _, u := range users {
+		if u.IsAdmin {
+			count++
+		}
+	}
+	return count
+}
+
+// アカウント削除（本人のみ）
+// 最後の管理者は削除できない（管理機能を使えるユーザーがいなくなるため409）
+// 判定と削除は同じロック内で行い、管理者2人が同時に削除して0人になることを防ぐ
+// 注文・ポイント履歴は監査のため残し、セッション・お気に入り・カートは削除する
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
 		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
@@ -1455,13 +8086,52 @@ func getRecommendationsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// おすすめ商品を取得
-	recommendations := getRecommendations(user.ID)
-	jsonResponse(w, http.StatusOK, recommendations)
+	userMux.Lock()
+	account := users[user.ID]
+	if account == nil {
+		userMux.Unlock()
+		errorResponse(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if account.IsAdmin && countAdmins() <= 1 {
+		userMux.Unlock()
+		errorResponse(w, http.StatusConflict, "Cannot delete the last admin account")
+		return
+	}
+	delete(users, account.ID)
+	delete(usersByName, account.Username)
+	userMux.Unlock()
+
+	// 対象ユーザーのセッションをすべて削除
+	sessionMux.Lock()
+	for token, sessionUser := range sessions {
+		if sessionUser != nil && sessionUser.ID == account.ID {
+			delete(sessions, token)
+			delete(sessionCreatedAt, token)
+		}
+	}
+	sessionMux.Unlock()
+
+	wishlistMux.Lock()
+	for key, wishlist := range wishlists {
+		if wishlist != nil && wishlist.UserID == account.ID {
+			delete(wishlists, key)
+		}
+	}
+	wishlistMux.Unlock()
+
+	cartMux.Lock()
+	delete(carts, account.ID)
+	cartMux.Unlock()
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"user_id": account.ID,
+		"deleted": true,
+	})
 }
 
-// ユーザー情報取得ハンドラー
-func getUserInfoHandler(w http.ResponseWriter, r *http.Request) {
+// 会員特典取得ハンドラー
+func getUserBenefitsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
@@ -1474,19 +8144,39 @@ func getUserInfoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// ユーザー情報をレスポンス用構造体に変換
-	response := UserInfoResponse{
-		ID:               user.ID,
-		Username:         user.Username,
-		IsAdmin:          user.IsAdmin,
-		Rank:             user.MemberRank,
-		TotalSpentAmount: user.TotalSpentAmount,
-		CurrentPoints:    user.CurrentPoints,
+	userMux.RLock()
+	rank := user.MemberRank
+	currentPoints := user.CurrentPoints
+	userMux.RUnlock()
+
+	response := UserBenefitsResponse{
+		Rank:          rank,
+		DiscountRate:  getRankDiscountRate(rank),
+		CurrentPoints: currentPoints,
+		FreeShipping:  hasFreeShippingRank(rank),
 	}
 
 	jsonResponse(w, http.StatusOK, response)
 }
 
+// ハンドラー内の panic を回復し、スタックをログに出して500を返す
+// 1件のリクエストの不具合でサーバー全体が止まらないようにする（詳細はクライアントに返さない）
+// http.ErrAbortHandler は net/http の意図的な中断なのでそのまま再送出する
+func recoverMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+				log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, rec, debug.Stack())
+				errorResponse(w, http.StatusInternalServerError, "Internal server error")
+			}
+		}()
+		next(w, r)
+	}
+}
+
 // メインハンドラー
 func mainHandler(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
@@ -1497,51 +8187,407 @@ func mainHandler(w http.ResponseWriter, r *http.Request) {
 		getProductsHandler(w, r)
 	case path == "/products" && r.Method == "POST":
 		createProductHandler(w, r)
+	case path == "/products/featured" && r.Method == "GET":
+		getFeaturedProductsHandler(w, r)
+	case strings.HasPrefix(path, "/products/") && strings.HasSuffix(path, "/coupons") && r.Method == "GET":
+		getProductCouponsHandler(w, r)
 	case strings.HasPrefix(path, "/products/") && r.Method == "GET":
 		getProductHandler(w, r)
 	case path == "/register" && r.Method == "POST":
 		registerHandler(w, r)
+	case path == "/register/check" && r.Method == "GET":
+		checkRegisterAvailabilityHandler(w, r)
 	case path == "/login" && r.Method == "POST":
 		loginHandler(w, r)
 	case path == "/orders" && r.Method == "POST":
 		createOrderHandler(w, r)
+	case path == "/shipping/estimate" && r.Method == "POST":
+		shippingEstimateHandler(w, r)
+	case path == "/orders/points-preview" && r.Method == "POST":
+		pointsPreviewHandler(w, r)
 	case path == "/orders" && r.Method == "GET":
 		getOrdersHandler(w, r)
+	case path == "/users/me/orders/export.csv" && r.Method == "GET":
+		exportOrdersCSVHandler(w, r)
+	case strings.HasPrefix(path, "/orders/") && strings.HasSuffix(path, "/receipt") && r.Method == "GET":
+		getOrderReceiptHandler(w, r)
+	case strings.HasPrefix(path, "/orders/") && strings.HasSuffix(path, "/history") && r.Method == "GET":
+		getOrderHistoryHandler(w, r)
+	case strings.HasPrefix(path, "/orders/") && strings.HasSuffix(path, "/refund") && r.Method == "POST":
+		refundOrderHandler(w, r)
+	case strings.HasPrefix(path, "/orders/") && strings.HasSuffix(path, "/cancel") && r.Method == "POST":
+		cancelOrderHandler(w, r)
 	case path == "/admin/reports/sales" && r.Method == "GET":
 		getSalesReportHandler(w, r)
+	case path == "/admin/reports/revenue-daily" && r.Method == "GET":
+		getDailyRevenueReportHandler(w, r)
+	case path == "/admin/reports/coupon-impact" && r.Method == "GET":
+		getCouponImpactReportHandler(w, r)
+	case path == "/admin/reports/ranks" && r.Method == "GET":
+		getRankDistributionReportHandler(w, r)
+	case path == "/admin/reports/never-sold" && r.Method == "GET":
+		getNeverSoldReportHandler(w, r)
+	case path == "/admin/orders/ship" && r.Method == "POST":
+		bulkShipOrdersHandler(w, r)
+	case path == "/admin/orders/to-fulfill" && r.Method == "GET":
+		getOrdersToFulfillHandler(w, r)
+	case strings.HasPrefix(path, "/admin/orders/by-transaction/") && r.Method == "GET":
+		getOrderByTransactionHandler(w, r)
+	case strings.HasPrefix(path, "/admin/orders/") && strings.HasSuffix(path, "/retry-payment") && r.Method == "POST":
+		retryOrderPaymentHandler(w, r)
+	case strings.HasPrefix(path, "/admin/products/") && strings.HasSuffix(path, "/sales") && r.Method == "GET":
+		getProductDailySalesHandler(w, r)
+	case strings.HasPrefix(path, "/admin/products/") && strings.HasSuffix(path, "/featured") && (r.Method == "PUT" || r.Method == "DELETE"):
+		setProductFeaturedHandler(w, r)
+	case path == "/admin/config" && r.Method == "GET":
+		getConfigHandler(w, r)
+	case path == "/admin/config" && r.Method == "PATCH":
+		updateConfigHandler(w, r)
+	case path == "/admin/sessions" && r.Method == "GET":
+		listSessionsHandler(w, r)
+	case path == "/admin/users/batch" && r.Method == "POST":
+		getUsersBatchHandler(w, r)
+	case strings.HasPrefix(path, "/admin/users/") && strings.HasSuffix(path, "/logout-all") && r.Method == "POST":
+		logoutAllSessionsHandler(w, r)
+	case strings.HasPrefix(path, "/admin/users/") && strings.HasSuffix(path, "/points") && r.Method == "GET":
+		getAdminUserPointsHandler(w, r)
+	case strings.HasPrefix(path, "/admin/users/") && strings.HasSuffix(path, "/ltv") && r.Method == "GET":
+		getUserLTVHandler(w, r)
+	case path == "/admin/category-sales" && r.Method == "POST":
+		createCategorySaleHandler(w, r)
+	case path == "/admin/category-sales" && r.Method == "GET":
+		getCategorySalesHandler(w, r)
+	case strings.HasPrefix(path, "/admin/category-sales/") && r.Method == "DELETE":
+		deleteCategorySaleHandler(w, r)
+	case path == "/admin/gift-rules" && r.Method == "POST":
+		createGiftRuleHandler(w, r)
+	case path == "/admin/gift-rules" && r.Method == "GET":
+		getGiftRulesHandler(w, r)
+	case strings.HasPrefix(path, "/admin/gift-rules/") && r.Method == "DELETE":
+		deleteGiftRuleHandler(w, r)
+	case path == "/admin/coupons/expiring" && r.Method == "GET":
+		getExpiringCouponsHandler(w, r)
+	case strings.HasPrefix(path, "/admin/coupons/") && strings.HasSuffix(path, "/orders") && r.Method == "GET":
+		getCouponOrdersHandler(w, r)
+	case path == "/admin/inventory" && r.Method == "GET":
+		getInventoryHandler(w, r)
+	case path == "/admin/stock/adjust" && r.Method == "POST":
+		adjustStockHandler(w, r)
+	case path == "/admin/stock/import" && r.Method == "POST":
+		importStockHandler(w, r)
+	case strings.HasPrefix(path, "/admin/warehouses/") && r.Method == "PATCH":
+		updateWarehouseHandler(w, r)
+	case strings.HasPrefix(path, "/warehouses/") && strings.HasSuffix(path, "/products") && r.Method == "GET":
+		getWarehouseProductsHandler(w, r)
+	case path == "/coupons/validate" && r.Method == "POST":
+		validateCouponsHandler(w, r)
+	case strings.HasPrefix(path, "/coupons/") && r.Method == "GET":
+		getCouponHandler(w, r)
+	case path == "/cart/validate" && r.Method == "POST":
+		validateCartHandler(w, r)
+	case path == "/cart" && r.Method == "GET":
+		getCartHandler(w, r)
+	case path == "/cart/items" && r.Method == "POST":
+		addCartItemHandler(w, r)
+	case strings.HasPrefix(path, "/cart/items/") && r.Method == "PATCH":
+		updateCartItemHandler(w, r)
+	case strings.HasPrefix(path, "/cart/items/") && r.Method == "DELETE":
+		removeCartItemHandler(w, r)
+	case path == "/cart/checkout" && r.Method == "POST":
+		checkoutCartHandler(w, r)
+	case path == "/cart/merge" && r.Method == "POST":
+		mergeCartHandler(w, r)
+	case path == "/wishlist/checkout-preview" && r.Method == "POST":
+		wishlistCheckoutPreviewHandler(w, r)
 	case strings.HasPrefix(path, "/wishlist/") && r.Method == "POST":
 		addToWishlistHandler(w, r)
 	case strings.HasPrefix(path, "/wishlist/") && r.Method == "DELETE":
 		removeFromWishlistHandler(w, r)
+	case path == "/users/me/frequent-products" && r.Method == "GET":
+		getFrequentProductsHandler(w, r)
 	case path == "/users/me/recommendations" && r.Method == "GET":
 		getRecommendationsHandler(w, r)
+	case path == "/users/me/points/history" && r.Method == "GET":
+		getPointHistoryHandler(w, r)
+	case path == "/users/me/rank-progress" && r.Method == "GET":
+		getRankProgressHandler(w, r)
+	case path == "/users/me/rank-preview" && r.Method == "GET":
+		getRankPreviewHandler(w, r)
+	case path == "/users/me/wishlist/value" && r.Method == "GET":
+		getWishlistValueHandler(w, r)
+	case path == "/users/me/benefits" && r.Method == "GET":
+		getUserBenefitsHandler(w, r)
+	case path == "/users/me" && r.Method == "DELETE":
+		deleteAccountHandler(w, r)
 	case path == "/users/me" && r.Method == "GET":
 		getUserInfoHandler(w, r)
+	case strings.HasPrefix(path, "/users/") && strings.HasSuffix(path, "/profile") && r.Method == "GET":
+		getPublicProfileHandler(w, r)
 	default:
 		errorResponse(w, http.StatusNotFound, "Not found")
 	}
 }
 
+// 直近の注文内容
+type recentOrderFingerprint struct {
+	fingerprint string
+	at          time.Time
+}
+
+// 注文明細から商品構成の指紋を作る（明細の順序には依存しない）
+func orderFingerprint(items []OrderItem) string {
+	quantities := make(map[int]int)
+	for _, item := range items {
+		quantities[item.ProductID] += item.Quantity
+	}
+	productIDs := make([]int, 0, len(quantities))
+	for productID := range quantities {
+		productIDs = append(productIDs, productID)
+	}
+	sort.Ints(productIDs)
+
+	parts := make([]string, len(productIDs))
+	for i, productID := range productIDs {
+		parts[i] = fmt.Sprintf("%d:%d", productID, quantities[productID])
+	}
+	return strings.Join(parts, ",")
+}
+
+// 重複注文でなければ注文内容を記録して true を返す
+// 同じ商品構成の注文が window 内に記録されている場合は false
+func registerRecentOrder(userID int, fingerprint string, window time.Duration) bool {
+	recentOrderMux.Lock()
+	defer recentOrderMux.Unlock()
+
+	now := time.Now()
+	if recent, exists := recentOrders[userID]; exists {
+		if recent.fingerprint == fingerprint && now.Sub(recent.at) < window {
+			return false
+		}
+	}
+	recentOrders[userID] = recentOrderFingerprint{fingerprint: fingerprint, at: now}
+	return true
+}
+
+// 注文が完了しなかった場合に記録を取り消す（再試行をブロックしないように）
+func clearRecentOrder(userID int, fingerprint string) {
+	recentOrderMux.Lock()
+	defer recentOrderMux.Unlock()
+
+	if recent, exists := recentOrders[userID]; exists && recent.fingerprint == fingerprint {
+		delete(recentOrders, userID)
+	}
+}
+
+// 固定期間内のリクエスト回数
+type rateLimitWindow struct {
+	start time.Time
+	count int
+}
+
+// リクエスト元のクライアントIP（ポートを除く）
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// ユーザー名の空き確認を許可するか判定し、許可する場合は回数を記録する
+// 期間内の回数が上限に達している場合は false（期間が過ぎた記録はここで掃除する）
+func allowRegisterCheck(cfg Config, key string, now time.Time) bool {
+	limit := cfg.RegisterCheckRateLimit
+	if limit <= 0 {
+		return true
+	}
+	window := cfg.RegisterCheckRateWindow
+
+	registerCheckMux.Lock()
+	defer registerCheckMux.Unlock()
+
+	for k, attempt := range registerCheckAttempts {
+		if now.Sub(attempt.start) >= window {
+			delete(registerCheckAttempts, k)
+		}
+	}
+
+	attempt := registerCheckAttempts[key]
+	if attempt == nil {
+		attempt = &rateLimitWindow{start: now}
+		registerCheckAttempts[key] = attempt
+	}
+	if attempt.count >= limit {
+		return false
+	}
+	attempt.count++
+	return true
+}
+
+// 保持期間を過ぎた決済失敗注文をアーカイブへ移す
+// before より前に作成された payment_failed の注文が対象で、移した件数を返す
+func archiveOldFailedOrders(before time.Time) int {
+	orderMux.Lock()
+	defer orderMux.Unlock()
+
+	var archived []*Order
+	for id, order := range orders {
+		if order.Status == "payment_failed" && order.CreatedAt.Before(before) {
+			archived = append(archived, order)
+			delete(orders, id)
+		}
+	}
+
+	// 注文ID順に追加（監査時に追いやすいように）
+	sort.Slice(archived, func(i, j int) bool {
+		return archived[i].ID < archived[j].ID
+	})
+	archivedOrders = append(archivedOrders, archived...)
+	return len(archived)
+}
+
+// 決済処理中（payment_processing）のまま before より前から状態が変わっていない注文をキャンセルする
+// 処理中に途中で失敗した（パニック・接続断など）注文が残り続けないようにするためのもの
+// 使用したまま戻していないポイントを戻す。キャンセルした件数を返す
+// （処理中の注文は在庫を引き当てていない。決済の再試行は決済成功後に引き当て、
+// その時点でキャンセル済みなら再試行側が引き当てた在庫を戻す）
+func cleanupStaleOrders(before time.Time) int {
+	now := time.Now()
+	var stale []*Order
+	orderMux.Lock()
+	for _, order := range orders {
+		if order.Status != "payment_processing" {
+			continue
+		}
+		since := order.CreatedAt
+		if n := len(order.StatusHistory); n > 0 {
+			since = order.StatusHistory[n-1].ChangedAt
+		}
+		if !since.Before(before) {
+			continue
+		}
+		setOrderStatus(order, "cancelled", 0) // 0 はシステムによる変更
+		cancelledAt := now
+		order.CancelledAt = &cancelledAt
+		order.CancelReason = cancelReasonAbandoned
+		stale = append(stale, order)
+	}
+	orderMux.Unlock()
+
+	// 状態を先に変えているため、処理中のハンドラーが後から完了させることはない
+	for _, order := range stale {
+		returnHeldPoints(order.UserID, order.ID)
+	}
+	return len(stale)
+}
+
+// 放置された処理中の注文のキャンセルを定期的に実行する
+func runStaleOrderSweeper(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if n := cleanupStaleOrders(time.Now().Add(-timeout)); n > 0 {
+			log.Printf("Cancelled %d orders stuck in payment_processing for more than %s", n, timeout)
+		}
+	}
+}
+
+// 決済失敗注文のアーカイブを定期的に実行する
+func runFailedOrderSweeper(interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if n := archiveOldFailedOrders(time.Now().Add(-retention)); n > 0 {
+			log.Printf("Archived %d failed orders older than %s", n, retention)
+		}
+	}
+}
+
 func main() {
 	port := "8081"
 
 	fmt.Printf("Starting EC Backend API server on port %s\n", port)
 	fmt.Println("\nAvailable endpoints:")
-	fmt.Println("  GET    /products                  - List all products (filter: ?category=xxx)")
+	fmt.Println("  GET    /products                  - List all products (filter: ?category=xxx&min_price=N&max_price=N)")
+	fmt.Println("  GET    /products/featured         - List featured in-stock products")
 	fmt.Println("  GET    /products/{id}             - Get product details")
+	fmt.Println("  GET    /products/{id}/coupons     - List coupons applicable to a product with unit discount")
 	fmt.Println("  POST   /products                  - Create product (admin only)")
 	fmt.Println("  POST   /register                  - Register new user")
+	fmt.Println("  GET    /register/check            - Check username availability (?username=, rate limited)")
 	fmt.Println("  POST   /login                     - Login")
 	fmt.Println("  POST   /orders                    - Create order (auth required)")
+	fmt.Println("  POST   /orders/points-preview     - Estimate points earned for an order without placing it (auth required)")
+	fmt.Println("  POST   /shipping/estimate         - Estimate shipping fee and amount left to free shipping (auth optional)")
 	fmt.Println("  GET    /orders                    - Get user's orders (auth required)")
-	fmt.Println("  GET    /admin/reports/sales       - Sales analysis report (admin only)")
+	fmt.Println("  GET    /users/me/orders/export.csv - Download user's order history as CSV (auth required)")
+	fmt.Println("  GET    /orders/{id}/receipt       - Get order receipt (owner or admin, ?format=money for formatted amounts)")
+	fmt.Println("  GET    /orders/{id}/history       - Get order status history (owner or admin)")
+	fmt.Println("  POST   /orders/{id}/cancel        - Cancel an order within the cancellation window (owner, or admin anytime)")
+	fmt.Println("  POST   /orders/{id}/refund        - Refund part of an order by product and quantity (admin only)")
+	fmt.Println("  GET    /admin/reports/sales       - Sales analysis report (admin only, ?warehouse_sort=name|stock_desc|stock_asc)")
+	fmt.Println("  GET    /admin/reports/never-sold  - Products with no completed sales, by stock desc (admin only)")
+	fmt.Println("  GET    /admin/reports/revenue-daily - Daily revenue of completed orders (admin only, ?from=&to=)")
+	fmt.Println("  GET    /admin/reports/coupon-impact - Total discount and usage per coupon (admin only)")
+	fmt.Println("  GET    /admin/reports/ranks       - Number of users at each member rank, by tier (admin only)")
+	fmt.Println("  GET    /admin/products/{id}/sales - Daily quantities sold of a product (admin only, ?from=&to=)")
+	fmt.Println("  GET    /admin/orders/by-transaction/{txn_id} - Find order by payment transaction ID (admin only)")
+	fmt.Println("  POST   /admin/orders/{id}/retry-payment - Retry payment of a payment_failed order (admin only)")
+	fmt.Println("  POST   /admin/orders/ship         - Mark completed orders as shipped with tracking (admin only)")
+	fmt.Println("  GET    /admin/orders/to-fulfill   - Completed, unshipped orders oldest first with warehouse picks (admin only)")
+	fmt.Println("  GET    /admin/config              - Get the effective runtime configuration without secrets (admin only)")
+	fmt.Println("  PATCH  /admin/config              - Update pricing and limit settings without a restart (admin only)")
+	fmt.Println("  GET    /admin/sessions            - List active sessions with masked tokens (admin only, ?user_id=N)")
+	fmt.Println("  POST   /admin/users/{id}/logout-all - Revoke all sessions of a user (admin only)")
+	fmt.Println("  GET    /admin/users/{id}/points   - Get a user's points balance and history (admin only)")
+	fmt.Println("  GET    /admin/users/{id}/ltv      - Get a user's lifetime value from completed orders (admin only)")
+	fmt.Println("  POST   /admin/users/batch         - Get info for multiple users by ID (admin only)")
+	fmt.Println("  GET    /admin/inventory           - Per-warehouse stock for all products (admin only, ?category=&sort=total_asc)")
+	fmt.Println("  POST   /admin/stock/adjust        - Adjust stock with a reason code (admin only)")
+	fmt.Println("  POST   /admin/stock/import        - Import stock counts from CSV (admin only)")
+	fmt.Println("  PATCH  /admin/warehouses/{id}     - Set a warehouse's capacity (admin only)")
+	fmt.Println("  PUT    /admin/products/{id}/featured - Mark product as featured with a rank (admin only)")
+	fmt.Println("  DELETE /admin/products/{id}/featured - Remove product from featured list (admin only)")
+	fmt.Println("  GET    /warehouses/{id}/products  - List products in stock at a warehouse")
+	fmt.Println("  GET    /coupons/{code}            - Get coupon details")
+	fmt.Println("  POST   /coupons/validate          - Check validity of multiple coupon codes (auth required)")
+	fmt.Println("  GET    /admin/coupons/{code}/orders - List orders that used a coupon (admin only, ?from=&to=)")
+	fmt.Println("  GET    /admin/coupons/expiring    - List coupons expiring soon (admin only, ?within=72h)")
+	fmt.Println("  POST   /admin/category-sales      - Create a category sale (admin only)")
+	fmt.Println("  GET    /admin/category-sales      - List category sales (admin only)")
+	fmt.Println("  DELETE /admin/category-sales/{id} - Delete a category sale (admin only)")
+	fmt.Println("  POST   /admin/gift-rules          - Create a free gift rule for orders above a threshold (admin only)")
+	fmt.Println("  GET    /admin/gift-rules          - List free gift rules (admin only)")
+	fmt.Println("  DELETE /admin/gift-rules/{id}     - Delete a free gift rule (admin only)")
 	fmt.Println("  POST   /wishlist/{product_id}     - Add product to wishlist (auth required)")
 	fmt.Println("  DELETE /wishlist/{product_id}     - Remove product from wishlist (auth required)")
+	fmt.Println("  POST   /wishlist/checkout-preview - Estimate an order for the wishlist (auth required)")
+	fmt.Println("  GET    /users/me/wishlist/value   - Get the total current price of the wishlist (auth required)")
+	fmt.Println("  POST   /cart/validate             - Check cart items for stock and price changes before checkout")
+	fmt.Println("  GET    /cart                      - Get the server-side cart (auth required)")
+	fmt.Println("  POST   /cart/items                - Add a product to the cart (auth required)")
+	fmt.Println("  PATCH  /cart/items/{product_id}   - Change the quantity of a product in the cart (auth required)")
+	fmt.Println("  DELETE /cart/items/{product_id}   - Remove a product from the cart (auth required)")
+	fmt.Println("  POST   /cart/checkout             - Place an order for the cart contents (auth required)")
+	fmt.Println("  POST   /cart/merge                - Merge a guest cart into the user's cart (auth required)")
 	fmt.Println("  GET    /users/me/recommendations  - Get personalized recommendations (auth required)")
+	fmt.Println("  GET    /users/me/frequent-products - Products included in 2+ completed orders, most frequent first (auth required)")
 	fmt.Println("  GET    /users/me                  - Get user info with rank and points (auth required)")
+	fmt.Println("  DELETE /users/me                  - Delete own account (auth required, the last admin cannot)")
+	fmt.Println("  GET    /users/me/benefits         - Get rank discount rate and shipping benefits (auth required)")
+	fmt.Println("  GET    /users/me/rank-progress    - Get progress toward the next member rank (auth required)")
+	fmt.Println("  GET    /users/me/rank-preview     - Preview rank after spending ?amount=N more (auth required)")
+	fmt.Println("  GET    /users/{id}/profile        - Get a user's public profile")
+	fmt.Println("  GET    /users/me/points/history   - Get point history (auth required, ?limit=&offset=&sort=asc|desc)")
 	fmt.Println("\nDefault admin credentials: username=admin, password=admin123")
 
-	http.HandleFunc("/", mainHandler)
+	// 古い決済失敗注文のアーカイブ
+	cfg := currentConfig()
+	go runFailedOrderSweeper(cfg.FailedOrderSweepInterval, cfg.FailedOrderRetention)
+	go runStaleOrderSweeper(cfg.StaleOrderSweepInterval, cfg.StaleOrderTimeout)
+
+	http.HandleFunc("/", recoverMiddleware(mainHandler))
 
 	if err := http.ListenAndServe(":"+port, nil); err != nil {
 		log.Fatal("Server failed to start:", err)